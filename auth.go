@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"github.com/labstack/echo/v4"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookieName = "mtt_session"
+	maxLoginFailures  = 5
+	lockoutDuration   = 15 * time.Minute
+)
+
+// sessionStore keeps issued sessions in memory, a token is "<id>.<hmac of id>"
+// so forged tokens are rejected before the map lookup, logout deletes the id
+type sessionStore struct {
+	key      []byte
+	ttl      time.Duration
+	sessions map[string]time.Time
+	failures map[string]*loginFailure
+	lock     sync.Mutex
+}
+
+type loginFailure struct {
+	count       int
+	lastFailed  time.Time
+	lockedUntil time.Time
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &sessionStore{
+		key:      key,
+		ttl:      ttl,
+		sessions: make(map[string]time.Time),
+		failures: make(map[string]*loginFailure),
+	}
+}
+
+func (s *sessionStore) sign(id string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *sessionStore) create() (string, time.Time) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	id := hex.EncodeToString(b)
+	expires := time.Now().Add(s.ttl)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for sid, exp := range s.sessions {
+		if exp.Before(now) {
+			delete(s.sessions, sid)
+		}
+	}
+	s.sessions[id] = expires
+	return id + "." + s.sign(id), expires
+}
+
+// sessionId returns the id of a valid token, or "" if the token is forged,
+// unknown or expired
+func (s *sessionStore) sessionId(token string) string {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0]))) {
+		return ""
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	expires, ok := s.sessions[parts[0]]
+	if !ok {
+		return ""
+	}
+	if expires.Before(time.Now()) {
+		delete(s.sessions, parts[0])
+		return ""
+	}
+	return parts[0]
+}
+
+func (s *sessionStore) remove(token string) {
+	id := s.sessionId(token)
+	if id == "" {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, id)
+}
+
+// lockedUntil returns when the lockout of ip ends, zero time if not locked
+func (s *sessionStore) lockedUntil(ip string) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f, ok := s.failures[ip]
+	if !ok || f.lockedUntil.Before(time.Now()) {
+		return time.Time{}
+	}
+	return f.lockedUntil
+}
+
+func (s *sessionStore) loginFailed(ip string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	// failures older than the lockout window are forgotten
+	for fip, f := range s.failures {
+		if f.lastFailed.Before(now.Add(-lockoutDuration)) && f.lockedUntil.Before(now) {
+			delete(s.failures, fip)
+		}
+	}
+	f, ok := s.failures[ip]
+	if !ok {
+		f = &loginFailure{}
+		s.failures[ip] = f
+	}
+	f.count++
+	f.lastFailed = now
+	if f.count >= maxLoginFailures {
+		f.lockedUntil = now.Add(lockoutDuration)
+		f.count = 0
+	}
+}
+
+func (s *sessionStore) loginSucceeded(ip string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.failures, ip)
+}
+
+// requestToken reads the session token from the cookie or a bearer header
+func requestToken(c echo.Context) string {
+	if auth := c.Request().Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if cookie, err := c.Cookie(sessionCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func authMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if sessions.sessionId(requestToken(c)) == "" {
+			return c.JSON(http.StatusUnauthorized, "unauthorized")
+		}
+		return next(c)
+	}
+}
+
+func loginHandler(c echo.Context) error {
+	body := model.LoginBody{}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	// RemoteAddr instead of RealIP, forwarded headers could be used to dodge the lockout
+	ip, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		ip = c.Request().RemoteAddr
+	}
+	if until := sessions.lockedUntil(ip); !until.IsZero() {
+		return c.JSON(http.StatusTooManyRequests, "too many failed logins, try again after "+until.Format(time.RFC3339))
+	}
+	if subtle.ConstantTimeCompare([]byte(*password), []byte(body.Password)) != 1 {
+		sessions.loginFailed(ip)
+		return c.JSON(http.StatusUnauthorized, model.LoginResponse{
+			Login:     "fail",
+			Pipelines: make([]model.PipelineInfo, 0),
+		})
+	}
+	sessions.loginSucceeded(ip)
+	token, expires := sessions.create()
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	infos := pipelineInfos()
+	for _, info := range infos {
+		sendMessage("status", info.Config.Name, info.Status)
+	}
+	return c.JSON(200, model.LoginResponse{
+		Login:     "ok",
+		Token:     token,
+		Pipelines: infos,
+	})
+}
+
+func logoutHandler(c echo.Context) error {
+	sessions.remove(requestToken(c))
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return c.JSON(200, "ok")
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	v2 "github.com/VirgilZhao/mailtohttp/email/v2"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"github.com/VirgilZhao/mailtohttp/utils"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+func loadConfigs() []model.ServiceConfig {
+	configs := make([]model.ServiceConfig, 0)
+	if !checkConfigExist(configFileName) {
+		return configs
+	}
+	jsonStr, err := readEncryptFile(configFileName)
+	if err != nil {
+		log.Println(err)
+		return configs
+	}
+	if err := json.Unmarshal(jsonStr, &configs); err == nil {
+		return configs
+	}
+	// config file written before pipelines existed holds one ServiceConfig
+	config := model.ServiceConfig{
+		ContentPatterns: make([]model.ServiceContentPattern, 0),
+	}
+	if err := json.Unmarshal(jsonStr, &config); err != nil {
+		log.Println(err)
+		return configs
+	}
+	config.Name = defaultName
+	log.Println("load legacy config as pipeline " + defaultName)
+	return append(configs, config)
+}
+
+func saveConfigs(configs []model.ServiceConfig) error {
+	bytes, err := json.Marshal(configs)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return writeEncryptFile(configFileName, bytes)
+}
+
+func loadEPConfigs() map[string]model.EmailPwdBody {
+	configs := make(map[string]model.EmailPwdBody)
+	if !checkConfigExist(configEPName) {
+		return configs
+	}
+	jsonStr, err := readEncryptFile(configEPName)
+	if err != nil {
+		log.Println(err)
+		return configs
+	}
+	if err := json.Unmarshal(jsonStr, &configs); err == nil {
+		log.Println("load EP config success!")
+		return configs
+	}
+	// ep file written before pipelines existed holds one EmailPwdBody
+	config := model.EmailPwdBody{}
+	if err := json.Unmarshal(jsonStr, &config); err != nil {
+		log.Println(err)
+		return configs
+	}
+	configs = make(map[string]model.EmailPwdBody)
+	configs[defaultName] = config
+	log.Println("load legacy EP config as pipeline " + defaultName)
+	return configs
+}
+
+func saveEPConfigs(configs map[string]model.EmailPwdBody) error {
+	bytes, err := json.Marshal(configs)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return writeEncryptFile(configEPName, bytes)
+}
+
+func loadTLSConfigs() map[string]model.TLSSettings {
+	configs := make(map[string]model.TLSSettings)
+	if !checkConfigExist(configTLSName) {
+		return configs
+	}
+	jsonStr, err := readEncryptFile(configTLSName)
+	if err != nil {
+		log.Println(err)
+		return configs
+	}
+	if err := json.Unmarshal(jsonStr, &configs); err != nil {
+		log.Println(err)
+	}
+	return configs
+}
+
+func saveTLSConfigs(configs map[string]model.TLSSettings) error {
+	bytes, err := json.Marshal(configs)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return writeEncryptFile(configTLSName, bytes)
+}
+
+// loadDesiredStates returns the state each pipeline was last started or
+// stopped to from the web page, the file has no secrets and is not encrypted
+func loadDesiredStates() map[string]string {
+	states := make(map[string]string)
+	bytes, err := ioutil.ReadFile(desiredStateFileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return states
+	}
+	if err := json.Unmarshal(bytes, &states); err != nil {
+		log.Println(err)
+	}
+	return states
+}
+
+// saveDesiredState records status for the pipeline, an empty status removes
+// it, must be called with pipelinesLock held
+func saveDesiredState(name, status string) error {
+	states := loadDesiredStates()
+	if status == "" {
+		delete(states, name)
+	} else {
+		states[name] = status
+	}
+	bytes, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dataDirName, 0777); err != nil {
+		return err
+	}
+	return v2.WriteFileAtomic(desiredStateFileName, bytes, 0666)
+}
+
+// readEncryptFile decrypts fileName, a file written by an older version with
+// AES-CBC is converted to the current format on the first read
+func readEncryptFile(fileName string) ([]byte, error) {
+	bytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if utils.IsEncryptedFile(bytes) {
+		return utils.DecryptFile(bytes, *encryptKey)
+	}
+	jsonStr, err := utils.AesDecryptCBC(bytes, []byte(*encryptKey))
+	if err != nil || !json.Valid(jsonStr) {
+		return nil, utils.ErrDecrypt
+	}
+	if err := writeEncryptFile(fileName, jsonStr); err != nil {
+		return nil, err
+	}
+	log.Printf("migrate %s to the authenticated encryption format\n", fileName)
+	return jsonStr, nil
+}
+
+func writeEncryptFile(fileName string, bytes []byte) error {
+	encryptBytes, err := utils.EncryptFile(bytes, *encryptKey)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	// replace the old file only after the new one is fully written
+	if err := v2.WriteFileAtomic(fileName, encryptBytes, 0600); err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// checkEncryptFiles makes sure the existing config files can be read with the
+// given key, otherwise the first save would overwrite them
+func checkEncryptFiles() error {
+	for _, fileName := range []string{configFileName, configEPName, configTLSName} {
+		if !checkConfigExist(fileName) {
+			continue
+		}
+		if _, err := readEncryptFile(fileName); err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package v2
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/utf7"
+	"io/ioutil"
+	"sync"
+)
+
+// maxActionAttempts is how often an action is tried before it is dropped
+const maxActionAttempts = 5
+
+// PendingAction is a message waiting for its success or failure action, the
+// action itself is looked up in the config when it is applied
+type PendingAction struct {
+	Source   model.MessageRef `json:"source"`
+	Success  bool             `json:"success"`
+	Attempts int              `json:"attempts"`
+}
+
+// ActionStore keeps the pending actions of a pipeline on disk. Deliveries
+// finish in SenderApp after the IMAP session is gone, so the actions are
+// applied by ReceiveApp on its next session
+type ActionStore struct {
+	fileName string
+	items    []PendingAction
+	lock     sync.Mutex
+}
+
+func NewActionStore(fileName string) *ActionStore {
+	store := &ActionStore{
+		fileName: fileName,
+		items:    make([]PendingAction, 0),
+	}
+	if bytes, err := ioutil.ReadFile(fileName); err == nil {
+		json.Unmarshal(bytes, &store.items)
+	}
+	return store
+}
+
+func (s *ActionStore) Add(source model.MessageRef, success bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.items = append(s.items, PendingAction{Source: source, Success: success})
+	return s.save()
+}
+
+// List returns a copy of the pending actions
+func (s *ActionStore) List() []PendingAction {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]PendingAction(nil), s.items...)
+}
+
+// Update deletes the done actions and counts an attempt for the failed ones,
+// failed actions that reach maxActionAttempts are deleted too and returned.
+// Actions added meanwhile are kept
+func (s *ActionStore) Update(done, failed []PendingAction) ([]PendingAction, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	items := make([]PendingAction, 0, len(s.items))
+	dropped := make([]PendingAction, 0)
+	for _, item := range s.items {
+		if containsAction(done, item) {
+			continue
+		}
+		if containsAction(failed, item) {
+			item.Attempts++
+			if item.Attempts >= maxActionAttempts {
+				dropped = append(dropped, item)
+				continue
+			}
+		}
+		items = append(items, item)
+	}
+	s.items = items
+	return dropped, s.save()
+}
+
+func containsAction(items []PendingAction, item PendingAction) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// save must be called with lock held
+func (s *ActionStore) save() error {
+	bytes, err := json.Marshal(s.items)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.fileName, bytes, 0666)
+}
+
+// ActionEmpty reports whether the action changes nothing
+func ActionEmpty(action model.MessageAction) bool {
+	return !action.Seen && action.Keyword == "" && action.CopyTo == "" && action.MoveTo == "" && !action.Delete
+}
+
+// ValidateAction checks that the action doesn't both move and delete and that
+// the keyword is a valid IMAP atom
+func ValidateAction(action model.MessageAction) error {
+	if action.MoveTo != "" && action.Delete {
+		return errors.New("a message can't be moved and deleted")
+	}
+	for _, c := range action.Keyword {
+		if c <= ' ' || c >= 0x7f || c == '\\' || c == '(' || c == ')' || c == '{' || c == '%' || c == '*' || c == '"' || c == ']' {
+			return errors.New("invalid keyword " + action.Keyword)
+		}
+	}
+	return nil
+}
+
+// applyAction runs action on the messages in uids of the selected mailbox:
+// flags first, then copy, then move or delete. MOVE and UID EXPUNGE are used
+// when the server supports them, otherwise the message is copied, flagged
+// \Deleted and the mailbox expunged
+func applyAction(c *client.Client, uids *imap.SeqSet, action model.MessageAction) error {
+	flags := make([]interface{}, 0)
+	if action.Seen {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if action.Keyword != "" {
+		flags = append(flags, action.Keyword)
+	}
+	if len(flags) > 0 {
+		if err := c.UidStore(uids, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil); err != nil {
+			return err
+		}
+	}
+	if action.CopyTo != "" {
+		if err := c.UidCopy(uids, action.CopyTo); err != nil {
+			return err
+		}
+	}
+	if action.MoveTo != "" {
+		if ok, _ := c.Support("MOVE"); ok {
+			return executeUid(c, "MOVE", uids, action.MoveTo)
+		}
+		if err := c.UidCopy(uids, action.MoveTo); err != nil {
+			return err
+		}
+		return deleteMessages(c, uids)
+	}
+	if action.Delete {
+		return deleteMessages(c, uids)
+	}
+	return nil
+}
+
+func deleteMessages(c *client.Client, uids *imap.SeqSet) error {
+	if err := c.UidStore(uids, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+	// plain EXPUNGE also removes messages other clients flagged \Deleted
+	if ok, _ := c.Support("UIDPLUS"); ok {
+		return executeUid(c, "EXPUNGE", uids, "")
+	}
+	return c.Expunge(nil)
+}
+
+// uidCommand is a UID command go-imap has no method for
+type uidCommand struct {
+	name    string
+	uids    *imap.SeqSet
+	mailbox string
+}
+
+func (cmd *uidCommand) Command() *imap.Command {
+	args := []interface{}{imap.RawString(cmd.name), cmd.uids}
+	if cmd.mailbox != "" {
+		mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.mailbox)
+		args = append(args, imap.FormatMailboxName(mailbox))
+	}
+	return &imap.Command{Name: "UID", Arguments: args}
+}
+
+func executeUid(c *client.Client, name string, uids *imap.SeqSet, mailbox string) error {
+	status, err := c.Execute(&uidCommand{name: name, uids: uids, mailbox: mailbox}, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
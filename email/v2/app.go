@@ -1,65 +1,366 @@
 package v2
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/VirgilZhao/mailtohttp/model"
+	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+	"io"
 	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	imapDialTimeout = 30 * time.Second
+	// go-imap keeps the deadline of a command until the next one starts, so
+	// the timeout must be longer than the NOOP and IDLE restart intervals
+	imapCommandTimeout  = 5 * time.Minute
+	idleRestartInterval = 4 * time.Minute
+	// time a cancelled worker has to log out before its connection is closed
+	imapLogoutGrace = 5 * time.Second
+)
+
+var errStopBySignal = errors.New("stop by signal")
+
 type App struct {
-	config        *model.ServiceConfig
-	client        *client.Client
-	msgChan       chan string
-	Name          string
-	IsInLoginLoop bool
-	stopLoginChan chan string
+	config      *model.ServiceConfig
+	client      *client.Client
+	msgChan     chan string
+	Name        string
+	tokenSource *TokenSource
+	state       string
+	stateError  string
+	stateSince  time.Time
+	stateLock   sync.Mutex
 }
 
-func (a *App) sendMessage(method string, text string) {
-	log.Println(a.Name + "-" + method + ":" + text)
-	data := model.SocketMessage{
-		MsgType: "message",
-		Data:    a.Name + "-" + method + ":" + text,
-	}
-	bytes, err := json.Marshal(&data)
-	if err != nil {
-		return
+// droppedMessages counts the messages publish dropped since the last one
+// that got through
+var droppedMessages uint64
+
+// publish hands msg to the web page without blocking the worker, when the
+// log hub falls behind the message is only in the process log and the event
+// log. The first
+// drop is logged and the number dropped once messages get through again
+func publish(msgChan chan string, msg string) {
+	select {
+	case msgChan <- msg:
+		if n := atomic.SwapUint64(&droppedMessages, 0); n > 0 {
+			log.Printf("%d messages were dropped, they are missing on the web page", n)
+		}
+	default:
+		if atomic.AddUint64(&droppedMessages, 1) == 1 {
+			log.Println("the log hub is behind, messages are dropped")
+		}
 	}
-	a.msgChan <- string(bytes)
 }
 
-func (a *App) login() error {
+// login connects right away and retries network failures with backoff until
+// it succeeds or ctx is cancelled, a rejected login returns an AuthError
+// without retrying
+func (a *App) login(ctx context.Context) error {
 	a.sendMessage("login", "Connecting to server ...")
-	t := time.NewTicker(5 * time.Second)
-LOOP:
+	b := &backoff{}
 	for {
-		a.IsInLoginLoop = true
-		select {
-		case <-t.C:
-			c, err := client.DialTLS(fmt.Sprintf("%s:%v", a.config.EmailSettings.ImapAddress, a.config.EmailSettings.ImapPort), nil)
-			if err != nil {
-				a.sendMessage("login", err.Error())
-				break
-			}
-			a.client = c
+		a.setState(StateConnecting, nil)
+		c, err := a.dial()
+		if err == nil {
+			terminateOnCancel(ctx, c)
 			a.sendMessage("login", "Connected")
-
-			if err := c.Login(a.config.EmailSettings.Email, a.config.EmailSettings.Password); err != nil {
-				a.sendMessage("login", err.Error())
-				break
+			a.setState(StateAuthenticating, nil)
+			err = a.authenticate(c)
+			if err == nil {
+				a.client = c
+				a.sendMessage("login", "Logged in")
+				return nil
 			}
-			a.sendMessage("login", "Logged in")
-			break LOOP
-		case <-a.stopLoginChan:
+			c.Logout()
+		}
+		a.sendWarn("login", err.Error())
+		if isAuthError(err) {
+			a.setState(StateStopped, err)
+			a.alert(err.Error() + ", fix the email account and save the pipeline")
+			return err
+		}
+		if !a.wait(ctx, b.next(), err) {
 			a.sendMessage("login", "stop by signal")
-			a.IsInLoginLoop = false
-			return errors.New("stop by signal")
+			return errStopBySignal
+		}
+	}
+}
+
+// latency formats the time since start for the logs
+func latency(start time.Time) string {
+	return time.Since(start).Round(time.Millisecond).String()
+}
+
+const (
+	SecurityTLS              = "tls"
+	SecurityStartTLS         = "starttls"
+	SecurityStartTLSOptional = "starttls-optional"
+	SecurityNone             = "none"
+)
+
+const (
+	SourceIMAP    = "imap"
+	SourcePOP3    = "pop3"
+	SourceSMTP    = "smtp"
+	SourceMaildir = "maildir"
+	SourceMbox    = "mbox"
+)
+
+// ValidSourceType reports whether sourceType is known, empty means IMAP
+func ValidSourceType(sourceType string) bool {
+	switch sourceType {
+	case "", SourceIMAP, SourcePOP3, SourceSMTP, SourceMaildir, SourceMbox:
+		return true
+	}
+	return false
+}
+
+// pollInterval returns the configured poll interval in seconds, def when it
+// is not set and at least min
+func pollInterval(interval, def, min int) int {
+	if interval <= 0 {
+		return def
+	}
+	if interval < min {
+		return min
+	}
+	return interval
+}
+
+// ValidSecurity reports whether security is a known connection mode, empty
+// means implicit TLS
+func ValidSecurity(security string) bool {
+	switch security {
+	case "", SecurityTLS, SecurityStartTLS, SecurityStartTLSOptional, SecurityNone:
+		return true
+	}
+	return false
+}
+
+// dial connects to the IMAP server with the configured security mode
+func (a *App) dial() (*client.Client, error) {
+	settings := a.config.EmailSettings
+	addr := fmt.Sprintf("%s:%v", settings.ImapAddress, settings.ImapPort)
+	tlsConfig, err := BuildTLSConfig(settings.ImapAddress, settings.TLS)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: imapDialTimeout}
+	switch settings.Security {
+	case SecurityNone:
+		a.sendWarn("login", "security mode none, credentials are sent in cleartext")
+		return withTimeout(client.DialWithDialer(dialer, addr))
+	case SecurityStartTLS, SecurityStartTLSOptional:
+		c, err := withTimeout(client.DialWithDialer(dialer, addr))
+		if err != nil {
+			return nil, err
 		}
+		ok, err := c.SupportStartTLS()
+		if err != nil {
+			c.Logout()
+			return nil, err
+		}
+		if !ok {
+			if settings.Security == SecurityStartTLS {
+				c.Logout()
+				return nil, errors.New("server doesn't support STARTTLS")
+			}
+			a.sendWarn("login", "server doesn't support STARTTLS, credentials are sent in cleartext")
+			return c, nil
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Logout()
+			return nil, err
+		}
+		return c, nil
+	default:
+		return withTimeout(client.DialWithDialerTLS(dialer, addr, tlsConfig))
 	}
-	a.IsInLoginLoop = false
+}
+
+// terminateOnCancel closes the connection of c when it is not logged out
+// imapLogoutGrace after ctx is done, ctx is only checked between commands and
+// a command blocked on a stalled connection would keep the worker from
+// returning
+func terminateOnCancel(ctx context.Context, c *client.Client) {
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.LoggedOut():
+			return
+		}
+		t := time.NewTimer(imapLogoutGrace)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			c.Terminate()
+		case <-c.LoggedOut():
+		}
+	}()
+}
+
+// withTimeout bounds every command of c, a half-open connection fails the
+// command instead of blocking the worker
+func withTimeout(c *client.Client, err error) (*client.Client, error) {
+	if err != nil {
+		return nil, err
+	}
+	c.Timeout = imapCommandTimeout
+	return c, nil
+}
+
+// authenticate logs in with the password or, for OAuth2 pipelines, with a
+// fresh access token over SASL XOAUTH2 or OAUTHBEARER. Only a reply that
+// rejects the credentials is an AuthError, a server that is unavailable or
+// over a limit ([UNAVAILABLE], [LIMIT], ...) is retried with backoff
+func (a *App) authenticate(c *client.Client) error {
+	saslClient, err := a.saslClient()
+	if err != nil {
+		return err
+	}
+	// go-imap drops the response code of a NO reply, it is read from the
+	// server side of the connection
+	codes := &respCodeRecorder{}
+	c.SetDebug(imap.NewDebugWriter(nil, codes))
+	if saslClient != nil {
+		err = c.Authenticate(saslClient)
+	} else {
+		err = c.Login(a.config.EmailSettings.Email, a.config.EmailSettings.Password)
+	}
+	if err != nil {
+		if connectionError(c, err) {
+			return err
+		}
+		if code := codes.Code(); !authFailureCode(code) {
+			return fmt.Errorf("[%s] %v", code, err)
+		}
+		return &AuthError{Err: err}
+	}
+	c.SetDebug(nil)
 	return nil
 }
+
+// authFailureCode reports whether a NO reply with code (RFC 5530) means the
+// credentials are wrong, a reply without code is taken as that too
+func authFailureCode(code string) bool {
+	switch code {
+	case "", "AUTHENTICATIONFAILED", "AUTHORIZATIONFAILED", "EXPIRED":
+		return true
+	}
+	return false
+}
+
+// respCodeRecorder keeps the response code of the last tagged NO or BAD reply
+// in the server data written to it
+type respCodeRecorder struct {
+	lock sync.Mutex
+	line []byte
+	code string
+}
+
+func (r *respCodeRecorder) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, b := range p {
+		if b != '\n' {
+			// a status line is short, longer lines are literals
+			if len(r.line) < 1024 {
+				r.line = append(r.line, b)
+			}
+			continue
+		}
+		fields := strings.SplitN(strings.TrimRight(string(r.line), "\r"), " ", 3)
+		r.line = r.line[:0]
+		if len(fields) < 2 || fields[0] == "*" || fields[0] == "+" {
+			continue
+		}
+		if status := strings.ToUpper(fields[1]); status != "NO" && status != "BAD" {
+			continue
+		}
+		r.code = ""
+		if len(fields) == 3 && strings.HasPrefix(fields[2], "[") {
+			if end := strings.IndexAny(fields[2], " ]"); end > 0 {
+				r.code = strings.ToUpper(fields[2][1:end])
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (r *respCodeRecorder) Code() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.code
+}
+
+// saslClient returns the OAuth2 SASL client of the pipeline, nil when the
+// pipeline logs in with a password
+func (a *App) saslClient() (sasl.Client, error) {
+	settings := a.config.EmailSettings
+	if settings.AuthType != AuthXOAuth2 && settings.AuthType != AuthOAuthBearer {
+		return nil, nil
+	}
+	if a.tokenSource == nil {
+		return nil, errors.New("OAuth2 is not configured")
+	}
+	token, err := a.tokenSource.Token()
+	if err != nil {
+		return nil, err
+	}
+	if settings.AuthType == AuthXOAuth2 {
+		return sasl.NewXoauth2Client(settings.Email, token), nil
+	}
+	return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+		Username: settings.Email,
+		Token:    token,
+		Host:     settings.ImapAddress,
+		Port:     settings.ImapPort,
+	}), nil
+}
+
+// deliverMail parses a raw mail, runs the patterns and hands the params to
+// sender. It returns whether params were queued, false when the mail can't be
+// parsed or a required pattern didn't match, an error means the mail should
+// be tried again later
+func (a *App) deliverMail(r io.Reader, sender Enqueuer, source *model.MessageRef) (bool, error) {
+	content, err := ParseMail(r)
+	if err != nil {
+		a.sendForMessage(LevelError, "ProcessMessage", source, err.Error())
+		if content == nil {
+			return false, nil
+		}
+	}
+	for _, filename := range content.Attachments {
+		a.sendForMessage(LevelInfo, "ProcessMessage", source, fmt.Sprintf("Got attachment: %v", filename))
+	}
+	return a.decodeEmail(content, sender, source)
+}
+
+func (a *App) decodeEmail(mc *MailContent, sender Enqueuer, source *model.MessageRef) (bool, error) {
+	result := Extract(mc, a.config.ContentPatterns)
+	for _, match := range result.Patterns {
+		if match.Error != "" {
+			a.sendForMessage(LevelWarn, "decodeEmail", source, match.Param+": "+match.Error)
+		}
+	}
+	if !result.Send {
+		a.sendForMessage(LevelInfo, "decodeEmail", source, fmt.Sprintf("required patterns %v not matched, skip", result.RequireFailed))
+		return false, nil
+	}
+	a.sendForMessage(LevelInfo, "decodeEmail", source, fmt.Sprintf("%v", result.Params))
+	if err := sender.Enqueue(result.Params, source); err != nil {
+		a.sendForMessage(LevelError, "decodeEmail", source, "enqueue error:"+err.Error())
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,16 @@
+package v2
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// WriteFileAtomic writes data to a temp file next to fileName and renames it,
+// so a crash never leaves a truncated file behind
+func WriteFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	tmpName := fileName + ".tmp"
+	if err := ioutil.WriteFile(tmpName, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
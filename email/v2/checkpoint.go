@@ -0,0 +1,37 @@
+package v2
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// Checkpoint records how far ReceiveApp has processed a mailbox, UIDs are
+// only meaningful while the mailbox UIDVALIDITY stays the same
+type Checkpoint struct {
+	UidValidity uint32 `json:"uidValidity"`
+	LastUid     uint32 `json:"lastUid"`
+}
+
+func loadCheckpoint(fileName string) (*Checkpoint, error) {
+	cp := &Checkpoint{}
+	bytes, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	if err := json.Unmarshal(bytes, cp); err != nil {
+		return &Checkpoint{}, err
+	}
+	return cp, nil
+}
+
+func (cp *Checkpoint) save(fileName string) error {
+	bytes, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(fileName, bytes, 0666)
+}
@@ -0,0 +1,93 @@
+package v2
+
+import (
+	"encoding/json"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"log"
+	"strings"
+	"time"
+)
+
+// event levels, a query for one level returns it and the levels above
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+var levelRanks = map[string]int{LevelDebug: 0, LevelInfo: 1, LevelWarn: 2, LevelError: 3}
+
+// EventSink stores every event, the workers call it before the event goes on
+// to the web page so the event log keeps what the page may drop. It is set
+// once before any pipeline starts and may fill in the Seq
+var EventSink func(e *model.Event) error
+
+// LevelRank orders the levels, -1 for an unknown level
+func LevelRank(level string) int {
+	if rank, ok := levelRanks[level]; ok {
+		return rank
+	}
+	return -1
+}
+
+func (a *App) sendDebug(method, text string) {
+	a.sendEvent(model.Event{Level: LevelDebug, Method: method, Message: text})
+}
+
+func (a *App) sendMessage(method, text string) {
+	a.sendEvent(model.Event{Level: LevelInfo, Method: method, Message: text})
+}
+
+func (a *App) sendWarn(method, text string) {
+	a.sendEvent(model.Event{Level: LevelWarn, Method: method, Message: text})
+}
+
+func (a *App) sendError(method, text string) {
+	a.sendEvent(model.Event{Level: LevelError, Method: method, Message: text})
+}
+
+// sendEvent fills in the time, pipeline and component of e, prints it and
+// sends it to the event log and the web page
+func (a *App) sendEvent(e model.Event) {
+	a.publishEvent("message", e)
+}
+
+func (a *App) publishEvent(msgType string, e model.Event) {
+	e.Time = time.Now().UnixNano() / int64(time.Millisecond)
+	e.Pipeline = a.config.Name
+	e.Component = a.Name
+	text := e.Component + "-" + e.Method + ":" + e.Message
+	if e.Level != LevelInfo {
+		log.Println("[" + e.Pipeline + "] " + strings.ToUpper(e.Level) + " " + text)
+	} else {
+		log.Println("[" + e.Pipeline + "] " + text)
+	}
+	if EventSink != nil {
+		if err := EventSink(&e); err != nil {
+			log.Println("event log error:" + err.Error())
+		}
+	}
+	data := model.SocketMessage{
+		MsgType:  msgType,
+		Pipeline: e.Pipeline,
+		Data:     text,
+		Event:    &e,
+	}
+	bytes, err := json.Marshal(&data)
+	if err != nil {
+		return
+	}
+	publish(a.msgChan, string(bytes))
+}
+
+// sendForMessage logs an event about the mail source refers to, source is
+// nil for mails that don't come from IMAP
+func (a *App) sendForMessage(level, method string, source *model.MessageRef, text string) {
+	e := model.Event{Level: level, Method: method, Message: text}
+	if source != nil {
+		e.Uid = source.Uid
+		e.Fields = map[string]string{"folder": source.Folder}
+	}
+	a.sendEvent(e)
+}
@@ -0,0 +1,257 @@
+package v2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"github.com/emersion/go-message/mail"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	TargetBody    = "body"
+	TargetSubject = "subject"
+	TargetFrom    = "from"
+	TargetTo      = "to"
+	TargetDate    = "date"
+	// TargetHeader is followed by the header name, like "header:X-Mailer"
+	TargetHeader = "header:"
+)
+
+// MailContent is the parsed form of one mail which patterns are matched against
+type MailContent struct {
+	Header      mail.Header
+	Body        string
+	Attachments []string
+}
+
+// ParseMail reads a RFC 5322 message, Body keeps the text of the first inline
+// part (plain-text or HTML)
+func ParseMail(r io.Reader) (*MailContent, error) {
+	mr, err := mail.CreateReader(r)
+	if err != nil {
+		return nil, err
+	}
+	content := &MailContent{
+		Header:      mr.Header,
+		Attachments: make([]string, 0),
+	}
+	hasBody := false
+	// Process each message's part
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return content, err
+		}
+		switch h := p.Header.(type) {
+		case *mail.InlineHeader:
+			// This is the message's text (can be plain-text or HTML)
+			if !hasBody {
+				b, _ := ioutil.ReadAll(p.Body)
+				content.Body = string(b)
+				hasBody = true
+			}
+		case *mail.AttachmentHeader:
+			// This is an attachment
+			filename, _ := h.Filename()
+			content.Attachments = append(content.Attachments, filename)
+		}
+	}
+	return content, nil
+}
+
+// ValidTarget reports whether target can be used in a content pattern, an
+// empty target means the mail body
+func ValidTarget(target string) bool {
+	switch strings.ToLower(target) {
+	case "", TargetBody, TargetSubject, TargetFrom, TargetTo, TargetDate:
+		return true
+	}
+	return strings.HasPrefix(strings.ToLower(target), TargetHeader) && len(target) > len(TargetHeader)
+}
+
+// TargetText returns the text a pattern with the given target is matched
+// against, header values are MIME decoded and repeated headers are joined by
+// new lines
+func (mc *MailContent) TargetText(target string) (string, error) {
+	switch strings.ToLower(target) {
+	case "", TargetBody:
+		return mc.Body, nil
+	case TargetSubject:
+		return mc.Header.Subject()
+	case TargetFrom:
+		return mc.headerText("From")
+	case TargetTo:
+		return mc.headerText("To")
+	case TargetDate:
+		return mc.Header.Get("Date"), nil
+	}
+	if !ValidTarget(target) {
+		return "", errors.New("unknown pattern target " + target)
+	}
+	return mc.headerText(target[len(TargetHeader):])
+}
+
+func (mc *MailContent) headerText(key string) (string, error) {
+	values := make([]string, 0)
+	fields := mc.Header.FieldsByKey(key)
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			// keep the raw value if it can't be decoded
+			value = fields.Value()
+		}
+		values = append(values, value)
+	}
+	return strings.Join(values, "\n"), nil
+}
+
+// ValidatePattern checks the target, regex and capture group of a pattern
+func ValidatePattern(pattern model.ServiceContentPattern) error {
+	if !ValidTarget(pattern.Target) {
+		return fmt.Errorf("invalid target %s of pattern %s", pattern.Target, pattern.Param)
+	}
+	valReg, err := regexp.Compile(pattern.Regex)
+	if err != nil {
+		return fmt.Errorf("invalid regex of pattern %s: %s", pattern.Param, err.Error())
+	}
+	if _, err := groupIndex(valReg, pattern.Group); err != nil {
+		return fmt.Errorf("invalid group of pattern %s: %s", pattern.Param, err.Error())
+	}
+	return nil
+}
+
+// groupIndex resolves a group given by index or name, an empty group is the
+// whole match
+func groupIndex(valReg *regexp.Regexp, group string) (int, error) {
+	if group == "" {
+		return 0, nil
+	}
+	if index, err := strconv.Atoi(group); err == nil {
+		if index < 0 || index > valReg.NumSubexp() {
+			return 0, fmt.Errorf("regex has no group %d", index)
+		}
+		return index, nil
+	}
+	index := valReg.SubexpIndex(group)
+	if index < 0 {
+		return 0, fmt.Errorf("regex has no group named %s", group)
+	}
+	return index, nil
+}
+
+// matchPattern runs the regex on text and returns the params it produces.
+// With a group only that submatch is returned, without a group a regex with
+// named groups returns one param per named group, otherwise the whole match
+// is returned under the pattern param name
+func matchPattern(valReg *regexp.Regexp, pattern model.ServiceContentPattern, text string) ([]model.Param, int, error) {
+	matches := valReg.FindAllStringSubmatch(text, -1)
+	if pattern.Group == "" && hasNamedGroup(valReg) {
+		params := make([]model.Param, 0)
+		for i, name := range valReg.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			params = append(params, model.Param{
+				Name:  name,
+				Value: submatchValues(matches, i),
+			})
+		}
+		return params, len(matches), nil
+	}
+	index, err := groupIndex(valReg, pattern.Group)
+	if err != nil {
+		return nil, 0, err
+	}
+	return []model.Param{{
+		Name:  pattern.Param,
+		Value: submatchValues(matches, index),
+	}}, len(matches), nil
+}
+
+func hasNamedGroup(valReg *regexp.Regexp) bool {
+	for _, name := range valReg.SubexpNames() {
+		if name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func submatchValues(matches [][]string, index int) []string {
+	vals := make([]string, 0)
+	for _, m := range matches {
+		vals = append(vals, m[index])
+	}
+	return vals
+}
+
+// ExtractResult is the outcome of matching all patterns of a pipeline on one
+// mail, Send is false when a required pattern didn't match
+type ExtractResult struct {
+	Send          bool
+	Params        []model.Param
+	Patterns      []model.PatternMatch
+	RequireFailed []string
+}
+
+// Extract runs every pattern on its target text of mc, all patterns are
+// evaluated even after a required pattern failed so the details are complete
+func Extract(mc *MailContent, patterns []model.ServiceContentPattern) *ExtractResult {
+	result := &ExtractResult{
+		Send:          true,
+		Params:        make([]model.Param, 0),
+		Patterns:      make([]model.PatternMatch, 0),
+		RequireFailed: make([]string, 0),
+	}
+	for _, pattern := range patterns {
+		match := model.PatternMatch{
+			Param:   pattern.Param,
+			Target:  pattern.Target,
+			Params:  make([]model.Param, 0),
+			Require: pattern.Require,
+		}
+		if match.Target == "" {
+			match.Target = TargetBody
+		}
+		valReg, err := regexp.Compile(pattern.Regex)
+		if err != nil {
+			match.Error = err.Error()
+			result.Patterns = append(result.Patterns, match)
+			continue
+		}
+		text, err := mc.TargetText(pattern.Target)
+		if err != nil {
+			match.Error = err.Error()
+		}
+		match.Text = text
+		params, count, err := matchPattern(valReg, pattern, text)
+		if err != nil {
+			match.Error = err.Error()
+			result.Patterns = append(result.Patterns, match)
+			continue
+		}
+		match.Matches = count
+		match.Params = params
+		result.Patterns = append(result.Patterns, match)
+		if pattern.Require && count == 0 {
+			result.Send = false
+			result.RequireFailed = append(result.RequireFailed, pattern.Param)
+			continue
+		}
+		result.Params = append(result.Params, params...)
+	}
+	return result
+}
+
+// CallbackBody is the json posted to the callback url
+func CallbackBody(params []model.Param) ([]byte, error) {
+	return json.Marshal(model.HttpBody{Params: params})
+}
@@ -0,0 +1,143 @@
+package v2
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message/textproto"
+	"io"
+	"strings"
+)
+
+// errMessageGone is returned when the message was expunged after its
+// BODYSTRUCTURE was fetched
+var errMessageGone = errors.New("message is gone")
+
+// every section is fetched with BODY.PEEK so reading a message doesn't set
+// \Seen, that is left to the message actions
+var (
+	headerSection = &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier}, Peek: true}
+	entireSection = &imap.BodySectionName{Peek: true}
+)
+
+// textPart walks the BODYSTRUCTURE like ParseMail walks the message and
+// returns the section path of the first text part that is not an attachment,
+// nil when there is none, and the file names of the attachments
+func textPart(bs *imap.BodyStructure) ([]int, []string) {
+	var found []int
+	attachments := make([]string, 0)
+	var walk func(part *imap.BodyStructure, path []int)
+	walk = func(part *imap.BodyStructure, path []int) {
+		if strings.EqualFold(part.MIMEType, "multipart") {
+			for i, child := range part.Parts {
+				walk(child, append(append([]int(nil), path...), i+1))
+			}
+			return
+		}
+		if strings.EqualFold(part.Disposition, "attachment") {
+			filename := part.DispositionParams["filename"]
+			if filename == "" {
+				filename = part.Params["name"]
+			}
+			attachments = append(attachments, filename)
+			return
+		}
+		if found == nil && strings.EqualFold(part.MIMEType, "text") {
+			found = path
+		}
+	}
+	walk(bs, []int{})
+	return found, attachments
+}
+
+// fetchText downloads the header and the text part of the message with uid,
+// attachments and other parts stay on the server. The text part is returned
+// as a message of its own with the header of the mail, so ParseMail reads it
+// like the full message. Without a BODYSTRUCTURE the whole message is fetched
+func fetchText(c *client.Client, uid uint32, bs *imap.BodyStructure) (io.Reader, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	if bs == nil || !strings.EqualFold(bs.MIMEType, "multipart") && strings.EqualFold(bs.MIMEType, "text") {
+		// a single part text message is all text
+		return fetchSections(c, seqset, entireSection)
+	}
+	path, _ := textPart(bs)
+	if path == nil {
+		// only the headers can be matched
+		header, err := fetchSections(c, seqset, headerSection)
+		if err != nil {
+			return nil, err
+		}
+		return joinPart(header, nil, nil)
+	}
+	mimeSection := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.MIMESpecifier, Path: path}, Peek: true}
+	textSection := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Path: path}, Peek: true}
+	messages := make(chan *imap.Message, 1)
+	if err := c.UidFetch(seqset, []imap.FetchItem{headerSection.FetchItem(), mimeSection.FetchItem(), textSection.FetchItem()}, messages); err != nil {
+		return nil, err
+	}
+	msg := <-messages
+	if msg == nil {
+		return nil, errMessageGone
+	}
+	header, mime, text := msg.GetBody(headerSection), msg.GetBody(mimeSection), msg.GetBody(textSection)
+	if header == nil || mime == nil || text == nil {
+		return nil, errors.New("server didn't return the text part")
+	}
+	return joinPart(header, mime, text)
+}
+
+func fetchSections(c *client.Client, seqset *imap.SeqSet, section *imap.BodySectionName) (io.Reader, error) {
+	messages := make(chan *imap.Message, 1)
+	if err := c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages); err != nil {
+		return nil, err
+	}
+	msg := <-messages
+	if msg == nil {
+		return nil, errMessageGone
+	}
+	r := msg.GetBody(section)
+	if r == nil {
+		return nil, errors.New("server didn't return message body")
+	}
+	return r, nil
+}
+
+// joinPart replaces the content headers of the mail header with the MIME
+// header of the part and appends the part body, without a part the message
+// gets an empty text body
+func joinPart(header, mime, body io.Reader) (io.Reader, error) {
+	h, err := textproto.ReadHeader(bufio.NewReader(header))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition"} {
+		h.Del(key)
+	}
+	if mime != nil {
+		partHeader, err := textproto.ReadHeader(bufio.NewReader(mime))
+		if err != nil {
+			return nil, err
+		}
+		fields := partHeader.Fields()
+		for fields.Next() {
+			if strings.HasPrefix(strings.ToLower(fields.Key()), "content-") {
+				h.Add(fields.Key(), fields.Value())
+			}
+		}
+	} else {
+		h.Set("Content-Type", "text/plain")
+	}
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, h); err != nil {
+		return nil, err
+	}
+	if body != nil {
+		if _, err := io.Copy(&buf, body); err != nil {
+			return nil, err
+		}
+	}
+	return &buf, nil
+}
@@ -0,0 +1,279 @@
+package v2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFilePollInterval = 5
+	minFilePollInterval     = 1
+)
+
+// FileApp reads mails from the local filesystem, either a Maildir whose new/
+// messages are moved to cur/ once processed, or an mbox file that is tailed
+// from the offset kept in offsetFile
+type FileApp struct {
+	App
+	offsetFile string
+	offset     *MboxOffset
+	// size of the mbox at the previous poll
+	mboxSize int64
+	sender   Enqueuer
+}
+
+// MboxOffset is how far FileApp has read an mbox file, a file smaller than
+// Offset was truncated or rotated and is read from the start again
+type MboxOffset struct {
+	Offset int64 `json:"offset"`
+}
+
+func NewFileApp(config *model.ServiceConfig, msgChan chan string, offsetFile string, sender Enqueuer) *FileApp {
+	name := "MaildirApp"
+	if config.EmailSettings.SourceType == SourceMbox {
+		name = "MboxApp"
+	}
+	return &FileApp{
+		App: App{
+			Name:    name,
+			config:  config,
+			msgChan: msgChan,
+		},
+		offsetFile: offsetFile,
+		sender:     sender,
+	}
+}
+
+// Start polls the Maildir or mbox until ctx is cancelled
+func (fa *FileApp) Start(ctx context.Context) {
+	defer fa.stopped()
+	interval := pollInterval(fa.config.EmailSettings.PollInterval, defaultFilePollInterval, minFilePollInterval)
+	fa.sendMessage("Start", fmt.Sprintf("watch %s every %ds", fa.config.EmailSettings.Path, interval))
+	t := time.NewTicker(time.Duration(interval) * time.Second)
+	defer t.Stop()
+	fa.poll()
+	for {
+		select {
+		case <-t.C:
+			fa.poll()
+		case <-ctx.Done():
+			fa.sendMessage("Start", "stop by signal")
+			return
+		}
+	}
+}
+
+func (fa *FileApp) poll() {
+	fa.setState(StateFetching, nil)
+	defer fa.setState(StateIdling, nil)
+	var err error
+	if fa.config.EmailSettings.SourceType == SourceMbox {
+		err = fa.pollMbox()
+	} else {
+		err = fa.pollMaildir()
+	}
+	if err != nil {
+		fa.sendError("Poll", err.Error())
+	}
+}
+
+// pollMaildir processes the messages in new/ oldest first, a message is moved
+// to cur/ after its params are queued, so it stays in new/ and is tried again
+// when queueing fails
+func (fa *FileApp) pollMaildir() error {
+	dir := fa.config.EmailSettings.Path
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for _, entry := range entries {
+		// files starting with a dot are not complete messages
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		fileName := filepath.Join(dir, "new", entry.Name())
+		f, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		fa.sendMessage("Poll", "new mail "+entry.Name())
+		_, err = fa.deliverMail(f, fa.sender, nil)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		// ":2,S" marks the message as seen for mail clients reading the Maildir
+		target := filepath.Join(dir, "cur", entry.Name()+":2,S")
+		if err := os.Rename(fileName, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pollMbox processes the messages appended since the last poll. A message is
+// complete when the next "From " line follows, the last one when the file
+// hasn't grown since the previous poll, a blank line at the end may as well be
+// the one between the headers and the body of a message being written
+func (fa *FileApp) pollMbox() error {
+	fileName := fa.config.EmailSettings.Path
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fa.offset == nil {
+		offset, err := loadMboxOffset(fa.offsetFile)
+		if err != nil {
+			fa.sendError("Poll", "load offset error:"+err.Error())
+		}
+		if offset == nil {
+			// first start, only mails appended from now on are processed
+			offset = &MboxOffset{Offset: info.Size()}
+			fa.sendMessage("Poll", fmt.Sprintf("no offset found, start from the end of %s", fileName))
+			if err := offset.save(fa.offsetFile); err != nil {
+				return err
+			}
+		}
+		fa.offset = offset
+	}
+	settled := info.Size() == fa.mboxSize
+	fa.mboxSize = info.Size()
+	if info.Size() < fa.offset.Offset {
+		fa.sendWarn("Poll", "mbox is smaller than the saved offset, it was truncated or rotated, read it from the start")
+		fa.offset.Offset = 0
+	}
+	if info.Size() == fa.offset.Offset {
+		return nil
+	}
+	if _, err := f.Seek(fa.offset.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	messages, err := readMboxMessages(bufio.NewReader(f), settled)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if _, err := fa.deliverMail(bytes.NewReader(msg.raw), fa.sender, nil); err != nil {
+			return err
+		}
+		fa.offset.Offset += msg.length
+		if err := fa.offset.save(fa.offsetFile); err != nil {
+			return err
+		}
+	}
+	if len(messages) > 0 {
+		fa.sendMessage("Poll", fmt.Sprintf("done, %d new messages, offset %d", len(messages), fa.offset.Offset))
+	}
+	return nil
+}
+
+type mboxMessage struct {
+	raw []byte
+	// bytes the message takes in the file, with the "From " line
+	length int64
+}
+
+// readMboxMessages splits r at "From " lines and unquotes ">From " lines
+// (mboxrd), the last message is only returned when the writer is done with it,
+// that is withLast is set and it ends with a blank line
+func readMboxMessages(r *bufio.Reader, withLast bool) ([]mboxMessage, error) {
+	messages := make([]mboxMessage, 0)
+	var current *mboxMessage
+	var body bytes.Buffer
+	var length int64
+	prevBlank := true
+	finish := func() {
+		current.raw = append([]byte(nil), body.Bytes()...)
+		current.length = length
+		messages = append(messages, *current)
+		body.Reset()
+		length = 0
+	}
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && !bytes.HasSuffix(line, []byte("\n")) {
+			// incomplete last line, the writer is not done yet
+			break
+		}
+		if len(line) > 0 {
+			if prevBlank && bytes.HasPrefix(line, []byte("From ")) {
+				if current != nil {
+					finish()
+				}
+				// lines before the first "From " are skipped but still
+				// counted, so the offset moves past them
+				current = &mboxMessage{}
+				length += int64(len(line))
+				prevBlank = false
+				continue
+			}
+			length += int64(len(line))
+			if current != nil {
+				body.Write(unquoteFromLine(line))
+			}
+			prevBlank = len(bytes.TrimRight(line, "\r\n")) == 0
+		}
+		if err == io.EOF {
+			if current != nil && prevBlank && withLast {
+				finish()
+			}
+			return messages, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// unquoteFromLine removes one ">" from a line like ">From " or ">>From "
+func unquoteFromLine(line []byte) []byte {
+	trimmed := bytes.TrimLeft(line, ">")
+	if len(trimmed) < len(line) && bytes.HasPrefix(trimmed, []byte("From ")) {
+		return line[1:]
+	}
+	return line
+}
+
+// loadMboxOffset returns nil when there is no offset file yet
+func loadMboxOffset(fileName string) (*MboxOffset, error) {
+	bytes, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	offset := &MboxOffset{}
+	if err := json.Unmarshal(bytes, offset); err != nil {
+		return nil, err
+	}
+	return offset, nil
+}
+
+func (o *MboxOffset) save(fileName string) error {
+	bytes, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(fileName, bytes, 0666)
+}
@@ -0,0 +1,91 @@
+package v2
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadMboxMessages(t *testing.T) {
+	first := "From a@example.org Mon Jan  1 00:00:00 2024\nSubject: one\n\ncode: 1\n\n"
+	second := "From b@example.org Mon Jan  1 00:00:01 2024\nSubject: two\n\n>From the bank\n>>From here\n\n"
+	tests := []struct {
+		name     string
+		mbox     string
+		withLast bool
+		raws     []string
+		lengths  []int64
+	}{
+		{
+			name: "empty",
+			mbox: "",
+			raws: []string{},
+		},
+		{
+			name:    "last message kept back",
+			mbox:    first + second,
+			raws:    []string{"Subject: one\n\ncode: 1\n\n"},
+			lengths: []int64{int64(len(first))},
+		},
+		{
+			name:     "with last",
+			mbox:     first + second,
+			withLast: true,
+			raws:     []string{"Subject: one\n\ncode: 1\n\n", "Subject: two\n\nFrom the bank\n>From here\n\n"},
+			lengths:  []int64{int64(len(first)), int64(len(second))},
+		},
+		{
+			name:     "From inside a paragraph is no separator",
+			mbox:     "From a@example.org\nSubject: one\n\nhello\nFrom here on\n\n",
+			withLast: true,
+			raws:     []string{"Subject: one\n\nhello\nFrom here on\n\n"},
+			lengths:  []int64{int64(len("From a@example.org\nSubject: one\n\nhello\nFrom here on\n\n"))},
+		},
+		{
+			name:     "incomplete last line",
+			mbox:     first + "From b@example.org\nSubject: tw",
+			withLast: true,
+			raws:     []string{"Subject: one\n\ncode: 1\n\n"},
+			lengths:  []int64{int64(len(first))},
+		},
+		{
+			name:     "last message without blank line",
+			mbox:     first + "From b@example.org\nSubject: two\n",
+			withLast: true,
+			raws:     []string{"Subject: one\n\ncode: 1\n\n"},
+			lengths:  []int64{int64(len(first))},
+		},
+		{
+			name:     "lines before the first From counted",
+			mbox:     "junk\n\n" + first,
+			withLast: true,
+			raws:     []string{"Subject: one\n\ncode: 1\n\n"},
+			lengths:  []int64{int64(len("junk\n\n" + first))},
+		},
+		{
+			name:     "crlf",
+			mbox:     "From a@example.org\r\nSubject: one\r\n\r\n>From x\r\n\r\n",
+			withLast: true,
+			raws:     []string{"Subject: one\r\n\r\nFrom x\r\n\r\n"},
+			lengths:  []int64{int64(len("From a@example.org\r\nSubject: one\r\n\r\n>From x\r\n\r\n"))},
+		},
+	}
+	for _, test := range tests {
+		messages, err := readMboxMessages(bufio.NewReader(strings.NewReader(test.mbox)), test.withLast)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(messages) != len(test.raws) {
+			t.Errorf("%s: %d messages, want %d", test.name, len(messages), len(test.raws))
+			continue
+		}
+		for i, msg := range messages {
+			if string(msg.raw) != test.raws[i] {
+				t.Errorf("%s: message %d is %q, want %q", test.name, i, msg.raw, test.raws[i])
+			}
+			if msg.length != test.lengths[i] {
+				t.Errorf("%s: message %d length %d, want %d", test.name, i, msg.length, test.lengths[i])
+			}
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package v2
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/VirgilZhao/mailtohttp/model"
 	idle "github.com/emersion/go-imap-idle"
@@ -11,37 +13,66 @@ import (
 type IdleApp struct {
 	App
 	idleClient   *idle.IdleClient
-	stopChan     chan string
 	MessageCount uint32
 }
 
 func NewIdleApp(config *model.ServiceConfig, msgChan chan string) *IdleApp {
 	return &IdleApp{
 		App: App{
-			Name:          "IdleApp",
-			config:        config,
-			msgChan:       msgChan,
-			stopLoginChan: make(chan string, 1),
+			Name:    "IdleApp",
+			config:  config,
+			msgChan: msgChan,
 		},
-		stopChan:     make(chan string, 1),
 		MessageCount: 0,
 	}
 }
 
-func (ia *IdleApp) Start(updateNotifyChan chan string) {
-START:
-	if err := ia.login(); err != nil {
-		ia.sendMessage("Start", "login error:"+err.Error())
-		return
+// Start listens for mailbox updates until ctx is cancelled, a dropped
+// connection is opened again after a backoff, a rejected login stops the app
+func (ia *IdleApp) Start(ctx context.Context, updateNotifyChan chan string) {
+	defer ia.stopped()
+	b := &backoff{}
+	for {
+		started := time.Now()
+		err := ia.listen(ctx, updateNotifyChan)
+		if err == nil || err == errStopBySignal || isAuthError(err) {
+			return
+		}
+		ia.sendWarn("start", "error:"+err.Error())
+		ia.sendWarn("start", "not idling")
+		// a session that lasted a while was fine, start the backoff over
+		if time.Since(started) > backoffMax {
+			b.reset()
+		}
+		if !ia.wait(ctx, b.next(), err) {
+			ia.sendMessage("start", "quit by stop signal")
+			return
+		}
+	}
+}
+
+// listen runs one IDLE session, it returns nil when ctx is cancelled
+func (ia *IdleApp) listen(ctx context.Context, updateNotifyChan chan string) error {
+	if err := ia.login(ctx); err != nil {
+		ia.sendWarn("Start", "login error:"+err.Error())
+		return err
 	}
 	defer ia.client.Logout()
 	mbox, err := ia.client.Select(ia.config.EmailSettings.Folder, false)
 	if err != nil {
-		ia.sendMessage("Start", err.Error())
-		return
+		return err
 	}
 	ia.sendMessage("Start", fmt.Sprintf("mailbox %s with flags %v", mbox.Name, mbox.Flags))
+	// mails may have arrived while the connection was down, ReceiveApp
+	// catches up from its checkpoint
+	ia.MessageCount = mbox.Messages
+	select {
+	case updateNotifyChan <- mbox.Name:
+	default:
+	}
 	ia.idleClient = idle.NewClient(ia.client)
+	// IDLE is one command, restarting it keeps it within imapCommandTimeout
+	ia.idleClient.LogoutTimeout = idleRestartInterval
 	updates := make(chan client.Update)
 	ia.client.Updates = updates
 	done := make(chan error, 1)
@@ -49,40 +80,63 @@ START:
 	go func() {
 		done <- ia.idleClient.IdleWithFallback(stop, 1*time.Minute)
 	}()
+	// updates are drained until the connection is closed so the client isn't
+	// blocked delivering one, IDLE has to end before Logout can be sent
+	idling := true
+	defer func() {
+		go func(c *client.Client) {
+			for {
+				select {
+				case <-updates:
+				case <-c.LoggedOut():
+					return
+				}
+			}
+		}(ia.client)
+		if idling {
+			close(stop)
+			<-done
+		}
+	}()
+	ia.setState(StateIdling, nil)
 	for {
-		ia.sendMessage("Start", "listen updates")
+		ia.sendDebug("Start", "listen updates")
 		select {
 		case update := <-updates:
-			ia.sendMessage("Start", "new update")
+			ia.sendDebug("Start", "new update")
 			switch update.(type) {
 			case *client.MailboxUpdate:
 				mailbox := update.(*client.MailboxUpdate)
 				ia.sendMessage("start", fmt.Sprintf("mailbox update found with total %d message", mailbox.Mailbox.Messages))
 				if ia.MessageCount != mailbox.Mailbox.Messages {
-					updateNotifyChan <- mailbox.Mailbox.Name
+					// ReceiveApp fetches every new message on one notification,
+					// don't block when notifications are already pending
+					select {
+					case updateNotifyChan <- mailbox.Mailbox.Name:
+					default:
+					}
 					ia.MessageCount = mailbox.Mailbox.Messages
 				}
 				break
+			case *client.ExpungeUpdate:
+				// keep the count in step, else the EXISTS of the next mail
+				// could repeat the old count and be missed
+				if ia.MessageCount > 0 {
+					ia.MessageCount--
+				}
+				break
 			default:
 				break
 			}
 		case err := <-done:
-			ia.sendMessage("start", "error:"+err.Error())
-			ia.sendMessage("start", "not idling")
-			goto START
-		case <-ia.stopChan:
+			idling = false
+			if err == nil {
+				err = errors.New("idle ended")
+			}
+			return err
+		case <-ctx.Done():
 			ia.sendMessage("start", "quit by stop signal")
-			return
+			return nil
 		}
 	}
 }
-
-func (ia *IdleApp) Stop() {
-	if ia.IsInLoginLoop {
-		ia.sendMessage("Stop", "stop login")
-		ia.stopLoginChan <- ""
-	} else {
-		ia.sendMessage("stop", "stop idle")
-		ia.stopChan <- ""
-	}
-}
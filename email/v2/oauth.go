@@ -0,0 +1,166 @@
+package v2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuthPassword    = "password"
+	AuthXOAuth2     = "xoauth2"
+	AuthOAuthBearer = "oauthbearer"
+
+	// access tokens are refreshed this long before they expire
+	tokenRefreshMargin = 2 * time.Minute
+)
+
+// ValidAuthType reports whether authType is known, empty means password
+func ValidAuthType(authType string) bool {
+	switch authType {
+	case "", AuthPassword, AuthXOAuth2, AuthOAuthBearer:
+		return true
+	}
+	return false
+}
+
+// TokenSource exchanges the refresh token of a pipeline for access tokens and
+// caches them until shortly before they expire, it is shared by the IMAP
+// workers of one pipeline so they don't refresh twice
+type TokenSource struct {
+	settings    model.OAuthSettings
+	accessToken string
+	expiry      time.Time
+	lock        sync.Mutex
+	// OnRefreshToken is called when the server rotates the refresh token, so
+	// the new one can be stored. It runs on its own goroutine without lock
+	// held, only the latest token is passed when rotations pile up
+	OnRefreshToken func(refreshToken string)
+	rotated        chan string
+	saveLock       sync.Mutex
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func NewTokenSource(settings model.OAuthSettings) *TokenSource {
+	return &TokenSource{settings: settings, rotated: make(chan string, 1)}
+}
+
+// Token returns a valid access token, refreshing it when needed
+func (ts *TokenSource) Token() (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.accessToken != "" && time.Now().Add(tokenRefreshMargin).Before(ts.expiry) {
+		return ts.accessToken, nil
+	}
+	if err := ts.refresh(); err != nil {
+		return "", err
+	}
+	return ts.accessToken, nil
+}
+
+// refresh must be called with lock held
+func (ts *TokenSource) refresh() error {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", ts.settings.RefreshToken)
+	form.Set("client_id", ts.settings.ClientId)
+	if ts.settings.ClientSecret != "" {
+		form.Set("client_secret", ts.settings.ClientSecret)
+	}
+	if ts.settings.Scope != "" {
+		form.Set("scope", ts.settings.Scope)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(ts.settings.TokenUrl, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	token := tokenResponse{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return tokenError(resp.StatusCode, "", fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, string(body)))
+	}
+	if resp.StatusCode != 200 || token.AccessToken == "" {
+		if token.Error != "" {
+			return tokenError(resp.StatusCode, token.Error, errors.New(strings.TrimSpace("token refresh failed: "+token.Error+" "+token.ErrorDescription)))
+		}
+		return tokenError(resp.StatusCode, "", fmt.Errorf("token endpoint returned status %d", resp.StatusCode))
+	}
+	ts.accessToken = token.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	if token.ExpiresIn <= 0 {
+		// no lifetime given, refresh on every new connection
+		ts.expiry = time.Now()
+	}
+	if token.RefreshToken != "" && token.RefreshToken != ts.settings.RefreshToken {
+		ts.settings.RefreshToken = token.RefreshToken
+		// replace a token that isn't saved yet, only refresh sends and it
+		// holds lock
+		select {
+		case <-ts.rotated:
+		default:
+		}
+		ts.rotated <- token.RefreshToken
+		go ts.saveRotated()
+	}
+	return nil
+}
+
+// saveRotated hands the pending rotated token to OnRefreshToken, saveLock
+// keeps the saves in order
+func (ts *TokenSource) saveRotated() {
+	ts.saveLock.Lock()
+	defer ts.saveLock.Unlock()
+	select {
+	case refreshToken := <-ts.rotated:
+		if ts.OnRefreshToken != nil {
+			ts.OnRefreshToken(refreshToken)
+		}
+	default:
+	}
+}
+
+// tokenError makes a rejected refresh an AuthError: a 400 or 401 with the
+// error invalid_grant or invalid_client, or without one. Anything else, like
+// 408, 429, 5xx or a 200 with a body that isn't json, is retried like a
+// network error
+func tokenError(statusCode int, code string, err error) error {
+	if statusCode != http.StatusBadRequest && statusCode != http.StatusUnauthorized {
+		return err
+	}
+	switch code {
+	case "", "invalid_grant", "invalid_client":
+		return &AuthError{Err: err}
+	}
+	return err
+}
+
+// ValidateOAuth checks the settings needed to refresh a token
+func ValidateOAuth(settings model.OAuthSettings) error {
+	u, err := url.Parse(settings.TokenUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid token url, use a http or https url")
+	}
+	if settings.ClientId == "" || settings.RefreshToken == "" {
+		return errors.New("client id and refresh token are required for OAuth2")
+	}
+	return nil
+}
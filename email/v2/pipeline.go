@@ -0,0 +1,437 @@
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatusRunning  = "running"
+	StatusStopping = "stopping"
+	StatusStopped  = "stopped"
+
+	stopWaitTimeout = 30 * time.Second
+)
+
+// ErrWorkersRunning is returned by Start while workers of the last run are
+// still busy
+var ErrWorkersRunning = errors.New("the workers of the last run are still stopping, try again later")
+
+// Pipeline owns the source workers (IdleApp and ReceiveApp, Pop3App, SmtpApp
+// or FileApp) and the SenderApp of one mailbox, every pipeline keeps its
+// checkpoint and delivery queue in its own data directory. opLock runs one
+// Start, Stop, Shutdown or Reload at a time and is held while workers are
+// waited for, lock only guards the fields so Status and Workers never wait
+type Pipeline struct {
+	Name             string
+	config           *model.ServiceConfig
+	msgChan          chan string
+	dataDir          string
+	idleApp          *IdleApp
+	receiveApp       *ReceiveApp
+	pop3App          *Pop3App
+	smtpApp          *SmtpApp
+	fileApp          *FileApp
+	senderApp        *SenderApp
+	senderLock       sync.RWMutex
+	sources          *supervisor
+	receiver         *supervisor
+	sender           *supervisor
+	updateNotifyChan chan string
+	status           string
+	lock             sync.Mutex
+	opLock           sync.Mutex
+	tokenSource      *TokenSource
+	actions          *ActionStore
+	// OnRefreshToken is called with the pipeline name when the OAuth2 server
+	// rotates the refresh token
+	OnRefreshToken func(name, refreshToken string)
+}
+
+func NewPipeline(config *model.ServiceConfig, msgChan chan string, dataDir string) *Pipeline {
+	return &Pipeline{
+		Name:             config.Name,
+		config:           config,
+		msgChan:          msgChan,
+		dataDir:          dataDir,
+		updateNotifyChan: make(chan string, 10),
+		status:           StatusStopped,
+		actions:          NewActionStore(filepath.Join(dataDir, "actions.json")),
+		sources:          newSupervisor(config.Name + " sources"),
+		receiver:         newSupervisor(config.Name + " ReceiveApp"),
+		sender:           newSupervisor(config.Name + " SenderApp"),
+	}
+}
+
+func (p *Pipeline) Status() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.status
+}
+
+// Workers returns the state of the source workers, empty when the pipeline
+// is stopped
+func (p *Pipeline) Workers() []model.WorkerStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	workers := make([]model.WorkerStatus, 0)
+	if p.status != StatusRunning {
+		return workers
+	}
+	switch {
+	case p.smtpApp != nil:
+		workers = append(workers, p.smtpApp.State())
+	case p.fileApp != nil:
+		workers = append(workers, p.fileApp.State())
+	case p.pop3App != nil:
+		workers = append(workers, p.pop3App.State())
+	case p.idleApp != nil:
+		workers = append(workers, p.idleApp.State())
+		// nil when the last ReceiveApp didn't stop in time on reload
+		if p.receiveApp != nil {
+			workers = append(workers, p.receiveApp.State())
+		}
+	}
+	return workers
+}
+
+// Start starts the workers, it fails while the pipeline is stopping or
+// workers of the last run that did not stop in time are still busy
+func (p *Pipeline) Start() error {
+	// checked before opLock, a Stop holds it while it waits
+	if status := p.Status(); status == StatusRunning {
+		return nil
+	} else if status == StatusStopping {
+		return ErrWorkersRunning
+	}
+	p.opLock.Lock()
+	defer p.opLock.Unlock()
+	if p.Status() == StatusRunning {
+		return nil
+	}
+	if !p.Exited() {
+		return ErrWorkersRunning
+	}
+	if err := os.MkdirAll(p.dataDir, 0777); err != nil {
+		log.Println(err)
+	}
+	p.newTokenSource()
+	p.startSender()
+	p.lock.Lock()
+	p.startSource()
+	p.lock.Unlock()
+	p.setStatus(StatusRunning)
+	return nil
+}
+
+// Exited reports whether every worker of the pipeline has returned
+func (p *Pipeline) Exited() bool {
+	return !p.sources.Running() && !p.receiver.Running() && !p.sender.Running()
+}
+
+func (p *Pipeline) Stop() {
+	p.opLock.Lock()
+	defer p.opLock.Unlock()
+	if p.Status() != StatusRunning {
+		return
+	}
+	p.setStatus(StatusStopping)
+	p.stopSource(stopWaitTimeout)
+	p.sender.Stop(stopWaitTimeout)
+	p.setStatus(StatusStopped)
+}
+
+// Shutdown stops the pipeline before the process exits: the mailbox workers
+// log out, then the sender gets until timeout to send the due deliveries,
+// what is left stays in the queue for the next start. The sender goes on
+// sending while the mailbox workers stop, that wait is bound by timeout too
+func (p *Pipeline) Shutdown(timeout time.Duration) {
+	p.opLock.Lock()
+	defer p.opLock.Unlock()
+	if p.Status() != StatusRunning {
+		return
+	}
+	p.setStatus(StatusStopping)
+	deadline := time.Now().Add(timeout)
+	p.stopSource(timeout)
+	p.senderLock.RLock()
+	p.senderApp.Drain(deadline)
+	p.senderLock.RUnlock()
+	p.sender.Wait(time.Until(deadline))
+	p.sender.Stop(stopWaitTimeout)
+	p.setStatus(StatusStopped)
+}
+
+// Enqueue hands params to the current SenderApp, ReceiveApp goes through the
+// pipeline so the sender can be replaced on reload while the receiver runs
+func (p *Pipeline) Enqueue(params []model.Param, source *model.MessageRef) error {
+	p.senderLock.RLock()
+	defer p.senderLock.RUnlock()
+	if p.senderApp == nil {
+		return ErrPipelineStopped
+	}
+	return p.senderApp.Enqueue(params, source)
+}
+
+// AcceptsRecipient reports whether mails pushed to rcpt belong to this
+// pipeline, with exact only full addresses count, not "@domain" entries
+func (p *Pipeline) AcceptsRecipient(rcpt string, exact bool) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return AcceptsRecipient(p.config, rcpt, exact)
+}
+
+// AllowSender and Deliver make the pipeline a MailTarget of SmtpServer, they
+// go to the current SmtpApp so a reload doesn't affect the server
+func (p *Pipeline) AllowSender(from string) error {
+	app := p.currentSmtpApp()
+	if app == nil {
+		return ErrPipelineStopped
+	}
+	return app.AllowSender(from)
+}
+
+func (p *Pipeline) Deliver(r io.Reader) error {
+	app := p.currentSmtpApp()
+	if app == nil {
+		return ErrPipelineStopped
+	}
+	return app.Deliver(r)
+}
+
+func (p *Pipeline) currentSmtpApp() *SmtpApp {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.status != StatusRunning {
+		return nil
+	}
+	return p.smtpApp
+}
+
+// Reload switches the pipeline to config, when the pipeline is running only
+// the workers whose settings changed are restarted, their names are returned.
+// Mailbox workers that are still busy after the stop wait can't be restarted,
+// the pipeline is stopped then
+func (p *Pipeline) Reload(config *model.ServiceConfig) []string {
+	p.opLock.Lock()
+	defer p.opLock.Unlock()
+	p.lock.Lock()
+	old := p.config
+	p.config = config
+	running := p.status == StatusRunning
+	p.lock.Unlock()
+	reloaded := make([]string, 0)
+	if !running {
+		return reloaded
+	}
+	mailboxChanged := !reflect.DeepEqual(old.EmailSettings, config.EmailSettings)
+	patternsChanged := !reflect.DeepEqual(old.ContentPatterns, config.ContentPatterns)
+	callbackChanged := old.CallbackUrl != config.CallbackUrl || old.CallbackSecret != config.CallbackSecret
+	refused := false
+	if mailboxChanged || (patternsChanged && p.receiveApp == nil) {
+		// the source workers are restarted together, for IMAP that is a
+		// reconnect of IdleApp too, the other sources read and decode in
+		// one worker
+		if mailboxChanged {
+			p.newTokenSource()
+		}
+		p.stopSource(stopWaitTimeout)
+		p.lock.Lock()
+		names := p.startSource()
+		p.lock.Unlock()
+		refused = names == nil
+		reloaded = append(reloaded, names...)
+	} else if patternsChanged {
+		// only ReceiveApp reads the patterns, IdleApp keeps its connection
+		p.receiver.Stop(stopWaitTimeout)
+		p.lock.Lock()
+		name := p.startReceiver()
+		p.lock.Unlock()
+		refused = name == ""
+		if !refused {
+			reloaded = append(reloaded, name)
+		}
+	}
+	if refused {
+		// the pipeline can't go on without its mailbox workers, it is stopped
+		// and can be started again once the old ones returned
+		p.setStatus(StatusStopping)
+		p.stopSource(stopWaitTimeout)
+		p.sender.Stop(stopWaitTimeout)
+		p.setStatus(StatusStopped)
+		p.send("reload", "config saved, the old mailbox workers did not stop in time, the pipeline is stopped")
+		return reloaded
+	}
+	if callbackChanged && p.startSender() {
+		reloaded = append(reloaded, p.senderApp.Name)
+	}
+	text := "config saved, nothing to reload"
+	if len(reloaded) > 0 {
+		text = "config reloaded: " + strings.Join(reloaded, ", ")
+	}
+	p.send("reload", text)
+	return reloaded
+}
+
+// deliveryFinished records the action for the source message and wakes up
+// ReceiveApp to apply it, it runs on the sender goroutine and must not take
+// opLock since Reload holds it while waiting for the sender to stop. Nothing
+// is recorded when no action is configured for the result
+func (p *Pipeline) deliveryFinished(source *model.MessageRef, delivered bool) {
+	p.lock.Lock()
+	action := p.config.EmailSettings.OnFailure
+	if delivered {
+		action = p.config.EmailSettings.OnSuccess
+	}
+	p.lock.Unlock()
+	if ActionEmpty(action) {
+		return
+	}
+	if err := p.actions.Add(*source, delivered); err != nil {
+		log.Println(p.Name + " save action error:" + err.Error())
+		return
+	}
+	select {
+	case p.updateNotifyChan <- "action":
+	default:
+	}
+}
+
+// the start and stop functions below must be called with opLock held,
+// startSource and startReceiver with lock held too
+
+// startSender replaces a running sender while Enqueue is blocked, so the new
+// sender loads a queue file that no other sender writes anymore. A sender
+// that doesn't stop in time keeps the queue and stays, false is returned
+func (p *Pipeline) startSender() bool {
+	p.senderLock.Lock()
+	if !p.sender.Stop(stopWaitTimeout) {
+		p.senderLock.Unlock()
+		log.Println(p.Name + " SenderApp did not stop in time, the old one keeps running")
+		return false
+	}
+	p.senderApp = NewSenderApp(p.config, p.msgChan, filepath.Join(p.dataDir, "queue.json"), filepath.Join(p.dataDir, "deadletter.json"))
+	p.senderApp.onFinish = p.deliveryFinished
+	p.senderLock.Unlock()
+	return p.sender.Start(p.senderApp.Start)
+}
+
+// startSource starts the workers reading the mailbox, IdleApp and ReceiveApp
+// for IMAP, Pop3App for POP3, SmtpApp for pushed mails or FileApp for a
+// Maildir or mbox, and returns their names. Nothing is started while the last
+// workers are still busy
+func (p *Pipeline) startSource() []string {
+	if p.sources.Running() || p.receiver.Running() {
+		log.Println(p.Name + " the mailbox workers did not stop in time, not restarted")
+		return nil
+	}
+	switch p.config.EmailSettings.SourceType {
+	case SourcePOP3:
+		p.pop3App = NewPop3App(p.config, p.msgChan, filepath.Join(p.dataDir, "pop3_uidl.json"), p)
+		p.pop3App.tokenSource = p.tokenSource
+		p.sources.Start(p.pop3App.Start)
+		return []string{p.pop3App.Name}
+	case SourceSMTP:
+		// SmtpServer calls into SmtpApp, there is no goroutine to supervise
+		p.smtpApp = NewSmtpApp(p.config, p.msgChan, p)
+		p.smtpApp.Start()
+		return []string{p.smtpApp.Name}
+	case SourceMaildir, SourceMbox:
+		p.fileApp = NewFileApp(p.config, p.msgChan, filepath.Join(p.dataDir, "mbox_offset.json"), p)
+		p.sources.Start(p.fileApp.Start)
+		return []string{p.fileApp.Name}
+	}
+	p.idleApp = NewIdleApp(p.config, p.msgChan)
+	p.idleApp.tokenSource = p.tokenSource
+	idleApp := p.idleApp
+	p.sources.Start(func(ctx context.Context) {
+		idleApp.Start(ctx, p.updateNotifyChan)
+	})
+	return []string{p.idleApp.Name, p.startReceiver()}
+}
+
+// startReceiver starts ReceiveApp on its own so a change of the patterns
+// doesn't reconnect IdleApp, it returns "" while the last one is still busy
+func (p *Pipeline) startReceiver() string {
+	if p.receiver.Running() {
+		log.Println(p.Name + " ReceiveApp did not stop in time, not restarted")
+		return ""
+	}
+	p.receiveApp = NewReceiveApp(p.config, p.msgChan, filepath.Join(p.dataDir, "checkpoint.json"), p)
+	p.receiveApp.tokenSource = p.tokenSource
+	p.receiveApp.actions = p.actions
+	receiveApp := p.receiveApp
+	p.receiver.Start(func(ctx context.Context) {
+		receiveApp.Start(ctx, p.updateNotifyChan)
+	})
+	return p.receiveApp.Name
+}
+
+// stopSource stops the mailbox workers and waits for them, at most timeout,
+// lock is only held to take the workers away
+func (p *Pipeline) stopSource(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	p.lock.Lock()
+	smtpApp := p.smtpApp
+	p.smtpApp = nil
+	p.fileApp = nil
+	p.pop3App = nil
+	p.idleApp = nil
+	p.receiveApp = nil
+	p.lock.Unlock()
+	if smtpApp != nil {
+		smtpApp.Stop()
+	}
+	p.sources.Stop(timeout)
+	p.receiver.Stop(time.Until(deadline))
+}
+
+// newTokenSource creates the token source shared by the IMAP workers when the
+// pipeline uses OAuth2
+func (p *Pipeline) newTokenSource() {
+	settings := p.config.EmailSettings
+	if settings.OAuth == nil || (settings.AuthType != AuthXOAuth2 && settings.AuthType != AuthOAuthBearer) {
+		p.tokenSource = nil
+		return
+	}
+	p.tokenSource = NewTokenSource(*settings.OAuth)
+	name := p.Name
+	onRefresh := p.OnRefreshToken
+	p.tokenSource.OnRefreshToken = func(refreshToken string) {
+		if onRefresh != nil {
+			onRefresh(name, refreshToken)
+		}
+	}
+}
+
+// setStatus must be called with opLock held
+func (p *Pipeline) setStatus(status string) {
+	p.lock.Lock()
+	p.status = status
+	p.lock.Unlock()
+	p.send("status", status)
+}
+
+func (p *Pipeline) send(msgType, text string) {
+	data := model.SocketMessage{
+		MsgType:  msgType,
+		Pipeline: p.Name,
+		Data:     text,
+	}
+	bytes, err := json.Marshal(&data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	publish(p.msgChan, string(bytes))
+}
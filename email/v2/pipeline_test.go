@@ -0,0 +1,124 @@
+package v2
+
+import (
+	"github.com/VirgilZhao/mailtohttp/model"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testConfig reads an empty Maildir, its FileApp and the SenderApp only wait
+// on their context, so no server is needed
+func testConfig(t *testing.T, maildir, callback string) *model.ServiceConfig {
+	for _, dir := range []string{"new", "cur", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(maildir, dir), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &model.ServiceConfig{
+		Name: "test",
+		EmailSettings: model.EmailSettings{
+			SourceType: SourceMaildir,
+			Path:       maildir,
+		},
+		ContentPatterns: []model.ServiceContentPattern{{Param: "code", Regex: `code: (\d+)`, Group: "1"}},
+		CallbackUrl:     callback,
+	}
+}
+
+func newTestPipeline(t *testing.T, config *model.ServiceConfig) *Pipeline {
+	// publish drops what doesn't fit, nobody has to read the messages
+	return NewPipeline(config, make(chan string, 10), t.TempDir())
+}
+
+func TestPipelineStartStop(t *testing.T) {
+	p := newTestPipeline(t, testConfig(t, t.TempDir(), "http://127.0.0.1:1/"))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal("second Start:", err)
+	}
+	if status := p.Status(); status != StatusRunning {
+		t.Fatalf("status %s after Start", status)
+	}
+	if workers := p.Workers(); len(workers) != 1 || workers[0].Name != "MaildirApp" {
+		t.Fatalf("workers %v", workers)
+	}
+	p.Stop()
+	p.Stop()
+	if status := p.Status(); status != StatusStopped {
+		t.Fatalf("status %s after Stop", status)
+	}
+	if !p.Exited() {
+		t.Fatal("workers still running after Stop")
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal("Start after Stop:", err)
+	}
+	p.Stop()
+}
+
+func TestPipelineReload(t *testing.T) {
+	maildir := t.TempDir()
+	p := newTestPipeline(t, testConfig(t, maildir, "http://127.0.0.1:1/"))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	config := testConfig(t, maildir, "http://127.0.0.1:2/")
+	if reloaded := p.Reload(config); len(reloaded) != 1 || reloaded[0] != "SenderApp" {
+		t.Fatalf("callback change reloaded %v", reloaded)
+	}
+	config = testConfig(t, maildir, "http://127.0.0.1:2/")
+	config.ContentPatterns[0].Group = "0"
+	if reloaded := p.Reload(config); len(reloaded) != 1 || reloaded[0] != "MaildirApp" {
+		t.Fatalf("patterns change reloaded %v", reloaded)
+	}
+	if reloaded := p.Reload(config); len(reloaded) != 0 {
+		t.Fatalf("same config reloaded %v", reloaded)
+	}
+}
+
+// TestPipelineConcurrent starts, stops and reloads one pipeline from several
+// goroutines while the status is read, run it with -race
+func TestPipelineConcurrent(t *testing.T) {
+	maildir := t.TempDir()
+	configs := []*model.ServiceConfig{
+		testConfig(t, maildir, "http://127.0.0.1:1/"),
+		testConfig(t, maildir, "http://127.0.0.1:2/"),
+		testConfig(t, t.TempDir(), "http://127.0.0.1:2/"),
+	}
+	configs[1].ContentPatterns[0].Group = "0"
+	p := newTestPipeline(t, configs[0])
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				switch (i + j) % 3 {
+				case 0:
+					if err := p.Start(); err != nil && err != ErrWorkersRunning {
+						t.Error(err)
+					}
+				case 1:
+					p.Reload(configs[j%len(configs)])
+				case 2:
+					p.Stop()
+				}
+				p.Status()
+				p.Workers()
+			}
+		}(i)
+	}
+	wg.Wait()
+	p.Stop()
+	if status := p.Status(); status != StatusStopped {
+		t.Fatalf("status %s after Stop", status)
+	}
+	if !p.Exited() {
+		t.Fatal("workers still running after Stop")
+	}
+}
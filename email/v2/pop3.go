@@ -0,0 +1,246 @@
+package v2
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"github.com/emersion/go-sasl"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const pop3DialTimeout = 30 * time.Second
+
+// Pop3Client is a minimal POP3 client (RFC 1939) with the STLS (RFC 2595) and
+// AUTH (RFC 5034) extensions, just what Pop3App needs
+type Pop3Client struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// Pop3ReplyError is a -ERR reply of the server, Text may start with a
+// response code like [IN-USE]
+type Pop3ReplyError struct {
+	Text string
+}
+
+func (e *Pop3ReplyError) Error() string {
+	return "pop3: " + e.Text
+}
+
+// Pop3Message is one entry of the UIDL listing
+type Pop3Message struct {
+	Id  int
+	Uid string
+}
+
+func DialPop3(addr string) (*Pop3Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, pop3DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return newPop3Client(conn)
+}
+
+func DialPop3TLS(addr string, config *tls.Config) (*Pop3Client, error) {
+	dialer := &net.Dialer{Timeout: pop3DialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return newPop3Client(conn)
+}
+
+func newPop3Client(conn net.Conn) (*Pop3Client, error) {
+	c := &Pop3Client{conn: conn, text: textproto.NewConn(conn)}
+	// the server greets first
+	if _, err := c.readResponse(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// readResponse reads a single line response, "-ERR" is returned as error
+func (c *Pop3Client) readResponse() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	}
+	if strings.HasPrefix(line, "-ERR") {
+		return "", &Pop3ReplyError{Text: strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))}
+	}
+	return "", errors.New("pop3: unexpected response " + line)
+}
+
+func (c *Pop3Client) cmd(format string, args ...interface{}) (string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.readResponse()
+}
+
+// cmdLines sends a command whose response is a multi-line listing
+func (c *Pop3Client) cmdLines(format string, args ...interface{}) ([]string, error) {
+	if _, err := c.cmd(format, args...); err != nil {
+		return nil, err
+	}
+	return c.text.ReadDotLines()
+}
+
+// Capabilities returns the CAPA listing, servers without CAPA return an error
+func (c *Pop3Client) Capabilities() (map[string]bool, error) {
+	lines, err := c.cmdLines("CAPA")
+	if err != nil {
+		return nil, err
+	}
+	caps := make(map[string]bool)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			caps[strings.ToUpper(fields[0])] = true
+		}
+	}
+	return caps, nil
+}
+
+func (c *Pop3Client) SupportStartTLS() bool {
+	caps, err := c.Capabilities()
+	return err == nil && caps["STLS"]
+}
+
+func (c *Pop3Client) StartTLS(config *tls.Config) error {
+	if _, err := c.cmd("STLS"); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	c.text = textproto.NewConn(tlsConn)
+	return nil
+}
+
+func (c *Pop3Client) Login(username, password string) error {
+	if _, err := c.cmd("USER %s", username); err != nil {
+		return err
+	}
+	_, err := c.cmd("PASS %s", password)
+	return err
+}
+
+// Authenticate runs a SASL exchange with the AUTH command
+func (c *Pop3Client) Authenticate(client sasl.Client) error {
+	mech, ir, err := client.Start()
+	if err != nil {
+		return err
+	}
+	line := "AUTH " + mech
+	if ir != nil {
+		line += " " + encodeSasl(ir)
+	}
+	if err := c.text.PrintfLine("%s", line); err != nil {
+		return err
+	}
+	for {
+		resp, err := c.text.ReadLine()
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(resp, "+OK") {
+			return nil
+		}
+		if strings.HasPrefix(resp, "-ERR") {
+			return &Pop3ReplyError{Text: strings.TrimSpace(strings.TrimPrefix(resp, "-ERR"))}
+		}
+		if !strings.HasPrefix(resp, "+") {
+			return errors.New("pop3: unexpected response " + resp)
+		}
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(resp, "+")))
+		if err != nil {
+			return err
+		}
+		answer, err := client.Next(challenge)
+		if err != nil {
+			// cancel the exchange, the server answers with -ERR
+			c.text.PrintfLine("*")
+			c.text.ReadLine()
+			return err
+		}
+		if err := c.text.PrintfLine("%s", encodeSasl(answer)); err != nil {
+			return err
+		}
+	}
+}
+
+func encodeSasl(b []byte) string {
+	if len(b) == 0 {
+		return "="
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Uidl lists the unique id of every message in the maildrop
+func (c *Pop3Client) Uidl() ([]Pop3Message, error) {
+	lines, err := c.cmdLines("UIDL")
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]Pop3Message, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("pop3: invalid UIDL line " + line)
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, errors.New("pop3: invalid UIDL line " + line)
+		}
+		messages = append(messages, Pop3Message{Id: id, Uid: fields[1]})
+	}
+	return messages, nil
+}
+
+// Retr returns the raw message, the reader must be read to the end before the
+// next command
+func (c *Pop3Client) Retr(id int) (io.Reader, error) {
+	if _, err := c.cmd("RETR %d", id); err != nil {
+		return nil, err
+	}
+	return c.text.DotReader(), nil
+}
+
+// Dele marks a message as deleted, it is removed when Quit succeeds
+func (c *Pop3Client) Dele(id int) error {
+	_, err := c.cmd("DELE %d", id)
+	return err
+}
+
+func (c *Pop3Client) Noop() error {
+	_, err := c.cmd("NOOP")
+	return err
+}
+
+// Quit ends the session and commits deletions
+func (c *Pop3Client) Quit() error {
+	defer c.conn.Close()
+	_, err := c.cmd("QUIT")
+	return err
+}
+
+// SetDeadline bounds the commands that follow, like net.Conn.SetDeadline
+func (c *Pop3Client) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Pop3Client) Close() error {
+	return c.conn.Close()
+}
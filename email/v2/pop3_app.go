@@ -0,0 +1,279 @@
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPop3PollInterval = 60
+	minPop3PollInterval     = 10
+	// every command, a RETR including the message, must finish in this time
+	pop3CommandTimeout = 2 * time.Minute
+)
+
+// Pop3App polls a POP3 maildrop, POP3 has no push so it replaces both IdleApp
+// and ReceiveApp. Messages are recognized by their UIDL, the ids already
+// processed are kept in seenFile. The value of seen tells whether the message
+// was queued, only those are deleted with DeleteAfterProcessing
+type Pop3App struct {
+	App
+	seenFile string
+	seen     map[string]bool
+	sender   Enqueuer
+}
+
+func NewPop3App(config *model.ServiceConfig, msgChan chan string, seenFile string, sender Enqueuer) *Pop3App {
+	return &Pop3App{
+		App: App{
+			Name:    "Pop3App",
+			config:  config,
+			msgChan: msgChan,
+		},
+		seenFile: seenFile,
+		sender:   sender,
+	}
+}
+
+// Start polls the maildrop until ctx is cancelled
+func (pa *Pop3App) Start(ctx context.Context) {
+	defer pa.stopped()
+	seen, err := loadSeenUids(pa.seenFile)
+	if err != nil {
+		pa.sendError("Start", "load seen uids error:"+err.Error())
+	}
+	pa.seen = seen
+	interval := pollInterval(pa.config.EmailSettings.PollInterval, defaultPop3PollInterval, minPop3PollInterval)
+	t := time.NewTicker(time.Duration(interval) * time.Second)
+	defer t.Stop()
+	// a rejected login stops the app, saving the pipeline starts it again
+	if err := pa.poll(ctx); isAuthError(err) {
+		return
+	}
+	for {
+		if ctx.Err() != nil {
+			pa.sendMessage("Start", "stop by signal")
+			return
+		}
+		pa.setState(StateIdling, nil)
+		pa.sendMessage("Start", fmt.Sprintf("next poll in %ds", interval))
+		select {
+		case <-t.C:
+			if err := pa.poll(ctx); isAuthError(err) {
+				return
+			}
+		case <-ctx.Done():
+			pa.sendMessage("Start", "stop by signal")
+			return
+		}
+	}
+}
+
+// dialPop3 connects with the configured security mode and logs in
+func (pa *Pop3App) dialPop3() (*Pop3Client, error) {
+	settings := pa.config.EmailSettings
+	addr := fmt.Sprintf("%s:%v", settings.ImapAddress, settings.ImapPort)
+	tlsConfig, err := BuildTLSConfig(settings.ImapAddress, settings.TLS)
+	if err != nil {
+		return nil, err
+	}
+	var c *Pop3Client
+	switch settings.Security {
+	case SecurityNone:
+		pa.sendWarn("login", "security mode none, credentials are sent in cleartext")
+		c, err = DialPop3(addr)
+	case SecurityStartTLS, SecurityStartTLSOptional:
+		c, err = DialPop3(addr)
+		if err != nil {
+			return nil, err
+		}
+		if !c.SupportStartTLS() {
+			if settings.Security == SecurityStartTLS {
+				c.Close()
+				return nil, errors.New("server doesn't support STLS")
+			}
+			pa.sendWarn("login", "server doesn't support STLS, credentials are sent in cleartext")
+		} else if err = c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	default:
+		c, err = DialPop3TLS(addr, tlsConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(pop3CommandTimeout))
+	saslClient, err := pa.saslClient()
+	if err == nil {
+		if saslClient != nil {
+			err = c.Authenticate(saslClient)
+		} else {
+			err = c.Login(settings.Email, settings.Password)
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, pop3AuthError(err)
+	}
+	return c, nil
+}
+
+// pop3AuthError makes a -ERR reply to the login an AuthError, unless its
+// response code (RFC 2449) says the failure is temporary
+func pop3AuthError(err error) error {
+	reply, ok := err.(*Pop3ReplyError)
+	if !ok {
+		return err
+	}
+	for _, code := range []string{"[IN-USE]", "[LOGIN-DELAY]", "[SYS/TEMP]"} {
+		if strings.HasPrefix(strings.ToUpper(reply.Text), code) {
+			return err
+		}
+	}
+	return &AuthError{Err: err}
+}
+
+// poll processes every message whose UIDL was not seen before, without delete
+// after processing the first poll only records the current messages, like the
+// IMAP checkpoint does. ctx is checked between messages, the session is ended
+// with QUIT so the deletions so far are committed. Only the login error is
+// returned, a rejected login stops the app
+func (pa *Pop3App) poll(ctx context.Context) error {
+	pa.setState(StateFetching, nil)
+	c, err := pa.dialPop3()
+	if err != nil {
+		pa.sendWarn("Poll", err.Error())
+		if isAuthError(err) {
+			pa.setState(StateStopped, err)
+			pa.alert(err.Error() + ", fix the email account and save the pipeline")
+		}
+		return err
+	}
+	pa.sendMessage("Poll", "Logged in")
+	// a server that stops answering must not hang the worker
+	deadline := func() {
+		c.SetDeadline(time.Now().Add(pop3CommandTimeout))
+	}
+	deadline()
+	messages, err := c.Uidl()
+	if err != nil {
+		pa.sendError("Poll", "UIDL error:"+err.Error())
+		c.Quit()
+		return nil
+	}
+	deleteAfter := pa.config.EmailSettings.DeleteAfterProcessing
+	if pa.seen == nil && deleteAfter {
+		// the maildrop is consumed, mails left from before are processed too
+		pa.seen = make(map[string]bool)
+	} else if pa.seen == nil {
+		pa.seen = make(map[string]bool)
+		for _, msg := range messages {
+			pa.seen[msg.Uid] = false
+		}
+		pa.sendMessage("Poll", fmt.Sprintf("no seen uids found, start from current maildrop with %d messages", len(messages)))
+	}
+	processed := 0
+	for _, msg := range messages {
+		if ctx.Err() != nil {
+			pa.sendMessage("Poll", "stop by signal, the rest is processed on the next poll")
+			break
+		}
+		queued, seen := pa.seen[msg.Uid]
+		if seen {
+			// queued before but the deletion was not committed
+			if deleteAfter && queued {
+				deadline()
+				if err := c.Dele(msg.Id); err != nil {
+					pa.sendError("Poll", "DELE error:"+err.Error())
+				}
+			}
+			continue
+		}
+		deadline()
+		queued, err := pa.processMessage(c, msg)
+		if err != nil {
+			pa.sendEvent(model.Event{Level: LevelError, Method: "Poll", Message: fmt.Sprintf("message %s: %s", msg.Uid, err.Error()), Fields: map[string]string{"uidl": msg.Uid}})
+			break
+		}
+		processed++
+		pa.seen[msg.Uid] = queued
+		if err := saveSeenUids(pa.seenFile, pa.seen, messages); err != nil {
+			pa.sendError("Poll", "save seen uids error:"+err.Error())
+		}
+		// a message that was skipped or could not be parsed stays on the server
+		if deleteAfter && queued {
+			deadline()
+			if err := c.Dele(msg.Id); err != nil {
+				pa.sendError("Poll", "DELE error:"+err.Error())
+			}
+		}
+	}
+	if err := saveSeenUids(pa.seenFile, pa.seen, messages); err != nil {
+		pa.sendError("Poll", "save seen uids error:"+err.Error())
+	}
+	deadline()
+	if err := c.Quit(); err != nil {
+		pa.sendWarn("Poll", "QUIT error:"+err.Error())
+	}
+	pa.sendMessage("Poll", fmt.Sprintf("done, %d new messages", processed))
+	return nil
+}
+
+// processMessage retrieves one message and delivers it, it returns whether the
+// params were queued. An error stops the poll so the message is tried again on
+// the next one
+func (pa *Pop3App) processMessage(c *Pop3Client, msg Pop3Message) (bool, error) {
+	r, err := c.Retr(msg.Id)
+	if err != nil {
+		return false, err
+	}
+	queued, deliverErr := pa.deliverMail(r, pa.sender, nil)
+	// the parser may stop early, the rest of the message must be consumed
+	// before the next command
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return false, err
+	}
+	return queued, deliverErr
+}
+
+// loadSeenUids returns nil when there is no seen file yet. The file maps each
+// uid to whether it was queued
+func loadSeenUids(fileName string) (map[string]bool, error) {
+	bytes, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	if err := json.Unmarshal(bytes, &seen); err != nil {
+		return nil, err
+	}
+	return seen, nil
+}
+
+// saveSeenUids keeps only the seen uids still in the maildrop, so the file
+// doesn't grow when mails are deleted on the server
+func saveSeenUids(fileName string, seen map[string]bool, messages []Pop3Message) error {
+	uids := make(map[string]bool)
+	for _, msg := range messages {
+		if queued, ok := seen[msg.Uid]; ok {
+			uids[msg.Uid] = queued
+		}
+	}
+	bytes, err := json.Marshal(uids)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(fileName, bytes, 0666)
+}
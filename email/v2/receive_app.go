@@ -1,187 +1,406 @@
 package v2
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
 	"github.com/VirgilZhao/mailtohttp/model"
 	"github.com/emersion/go-imap"
-	"github.com/emersion/go-message/mail"
-	"io"
-	"io/ioutil"
-	"net/http"
-	"regexp"
+	"sort"
+	"time"
 )
 
+// noopInterval is how often the idle session is checked, servers may log out
+// clients after 30 minutes without a command
+const noopInterval = 2 * time.Minute
+
 type ReceiveApp struct {
 	App
-	stopChan chan string
+	checkpointFile string
+	checkpoint     *Checkpoint
+	sender         Enqueuer
+	actions        *ActionStore
+}
+
+// Enqueuer accepts the params extracted from one mail for delivery, source
+// is the IMAP message they came from or nil for other sources
+type Enqueuer interface {
+	Enqueue(params []model.Param, source *model.MessageRef) error
 }
 
-func NewReceiveApp(config *model.ServiceConfig, msgChan chan string) *ReceiveApp {
+func NewReceiveApp(config *model.ServiceConfig, msgChan chan string, checkpointFile string, sender Enqueuer) *ReceiveApp {
 	return &ReceiveApp{
 		App: App{
-			Name:          "ReceiveApp",
-			config:        config,
-			msgChan:       msgChan,
-			stopLoginChan: make(chan string, 1),
+			Name:    "ReceiveApp",
+			config:  config,
+			msgChan: msgChan,
 		},
-		stopChan: make(chan string),
+		checkpointFile: checkpointFile,
+		sender:         sender,
 	}
 }
 
-func (ea *ReceiveApp) Start(updateMsgChan chan string) {
+// Start fetches new messages on every notification until ctx is cancelled
+func (ea *ReceiveApp) Start(ctx context.Context, updateMsgChan chan string) {
+	cp, err := loadCheckpoint(ea.checkpointFile)
+	if err != nil {
+		ea.sendError("Start", "load checkpoint error:"+err.Error())
+	}
+	ea.checkpoint = cp
+	defer ea.stopped()
+	defer ea.closeSession()
+	// catch up with mails arrived while the service was not running
+	if err := ea.getNewMessages(ctx); isAuthError(err) {
+		return
+	}
+	keepalive := time.NewTicker(noopInterval)
+	defer keepalive.Stop()
 	for {
+		ea.setState(StateIdling, nil)
 		ea.sendMessage("Start", "wait new email")
 		select {
 		case <-updateMsgChan:
-			ea.getLatestMessages(5)
+			// a rejected login stops the app, saving the pipeline starts it again
+			if err := ea.getNewMessages(ctx); isAuthError(err) {
+				return
+			}
 			break
-		case <-ea.stopChan:
+		case <-keepalive.C:
+			ea.keepalive()
+		case <-ctx.Done():
 			ea.sendMessage("Start", "stop by signal")
 			return
 		}
 	}
 }
 
-func (ea *ReceiveApp) Stop() {
-	if ea.IsInLoginLoop {
-		ea.sendMessage("Stop", "stop login")
-		ea.stopLoginChan <- ""
-	} else {
-		ea.sendMessage("Stop", "stop receive")
-		ea.stopChan <- ""
+// session returns the selected folder of the session kept from the last run,
+// a new session is started when there is none or the server closed it. The
+// folder is selected on every run to get a fresh UIDNEXT and UIDVALIDITY
+func (ea *ReceiveApp) session(ctx context.Context) (*imap.MailboxStatus, error) {
+	if ea.client != nil {
+		select {
+		case <-ea.client.LoggedOut():
+			ea.sendWarn("Session", "connection closed by server, reconnect")
+			ea.client = nil
+		default:
+		}
 	}
+	reused := ea.client != nil
+	if !reused {
+		if err := ea.login(ctx); err != nil {
+			return nil, err
+		}
+	}
+	mbox, err := ea.client.Select(ea.config.EmailSettings.Folder, false)
+	if err != nil && reused {
+		// a dead connection is often only noticed when it is used
+		ea.sendWarn("Session", "select error:"+err.Error()+", reconnect")
+		ea.closeSession()
+		if err := ea.login(ctx); err != nil {
+			return nil, err
+		}
+		mbox, err = ea.client.Select(ea.config.EmailSettings.Folder, false)
+	}
+	if err != nil {
+		ea.closeSession()
+		return nil, err
+	}
+	return mbox, nil
 }
 
-func (ea *ReceiveApp) getLatestMessages(count uint32) error {
-	if err := ea.login(); err != nil {
-		return err
+// keepalive sends a NOOP so the server doesn't close the idle session and a
+// dead connection is found before the next mail arrives
+func (ea *ReceiveApp) keepalive() {
+	if ea.client == nil {
+		return
 	}
-	defer ea.client.Logout()
-	mbox, err := ea.client.Select(ea.config.EmailSettings.Folder, false)
+	start := time.Now()
+	if err := ea.client.Noop(); err != nil {
+		ea.sendWarn("Keepalive", "noop error:"+err.Error()+", the next run reconnects")
+		ea.closeSession()
+		return
+	}
+	ea.sendDebug("Keepalive", fmt.Sprintf("noop ok in %s", latency(start)))
+}
+
+func (ea *ReceiveApp) closeSession() {
+	if ea.client == nil {
+		return
+	}
+	ea.client.Logout()
+	ea.client = nil
+}
+
+// getNewMessages fetches every message with UID greater than the checkpoint,
+// the checkpoint is advanced and saved after each processed message
+func (ea *ReceiveApp) getNewMessages(ctx context.Context) (err error) {
+	mbox, err := ea.session(ctx)
 	if err != nil {
-		ea.sendMessage("GetLatestMessages", err.Error())
+		ea.sendWarn("GetNewMessages", err.Error())
 		return err
 	}
-	from := uint32(1)
-	to := mbox.Messages
-	if mbox.Messages > count {
-		from = mbox.Messages - count
+	ea.setState(StateFetching, nil)
+	defer func() {
+		// the connection may be broken, the next run starts a new session
+		if err != nil {
+			ea.closeSession()
+		}
+	}()
+	if ea.checkpoint.UidValidity != mbox.UidValidity {
+		if err := ea.resync(mbox); err != nil {
+			ea.sendError("GetNewMessages", "resync error:"+err.Error())
+			return err
+		}
+		return nil
 	}
+	ea.applyActions()
 
 	seqset := new(imap.SeqSet)
-	seqset.AddRange(from, to)
-	// Get the whole message body
-	section := &imap.BodySectionName{}
-
-	messages := make(chan *imap.Message, 1)
+	// 0 stands for "*", the largest UID in the mailbox
+	seqset.AddRange(ea.checkpoint.LastUid+1, 0)
+	// every message up to here is covered by the search, so the checkpoint
+	// can move past the ones that didn't match
+	searchedUid := uint32(0)
+	filter := ea.config.EmailSettings.Filter
+	if !FilterEmpty(filter) {
+		if mbox.UidNext > 0 {
+			searchedUid = mbox.UidNext - 1
+		}
+		matched, err := ea.search(filter, seqset)
+		if err != nil {
+			ea.sendError("GetNewMessages", "search error:"+err.Error())
+			return err
+		}
+		if matched == nil {
+			ea.advanceCheckpoint(searchedUid)
+			ea.sendMessage("GetNewMessages", fmt.Sprintf("no message matches the filter, last uid %d", ea.checkpoint.LastUid))
+			return nil
+		}
+		seqset = matched
+	}
+	// the size and structure come first, the text is fetched per message
+	messages := make(chan *imap.Message, 10)
 	done := make(chan error, 1)
 	go func() {
-		done <- ea.client.Fetch(seqset, []imap.FetchItem{section.FetchItem()}, messages)
+		done <- ea.client.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchBodyStructure}, messages)
 	}()
+	list := make([]*imap.Message, 0)
 	for msg := range messages {
-		r := msg.GetBody(section)
-		if r == nil {
-			ea.sendMessage("GetLatestMessages", "Server didn't returned message body")
-			continue
-		}
-		// Create a new mail reader
-		mr, err := mail.CreateReader(r)
-		if err != nil {
-			ea.sendMessage("GetLatestMessages", err.Error())
-			continue
-		}
-		// Process each message's part
-		for {
-			p, err := mr.NextPart()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				ea.sendMessage("GetLatestMessages", err.Error())
-				continue
-			}
-
-			success := false
-			switch h := p.Header.(type) {
-			case *mail.InlineHeader:
-				// This is the message's text (can be plain-text or HTML)
-				b, _ := ioutil.ReadAll(p.Body)
-				//log.Println("Got text: %v", string(b))
-				if ea.decodeEmail(string(b)) {
-					success = true
-				}
-			case *mail.AttachmentHeader:
-				// This is an attachment
-				filename, _ := h.Filename()
-				ea.sendMessage("GetLatestMessages", fmt.Sprintf("Got attachment: %v", filename))
-			default:
-				break
-			}
-			if success {
-				break
-			}
+		// "n:*" always matches the last message even if its UID is lower than n
+		if msg.Uid > ea.checkpoint.LastUid {
+			list = append(list, msg)
 		}
 	}
 	if err := <-done; err != nil {
-		ea.sendMessage("GetLatestMessages", err.Error())
+		ea.sendError("GetNewMessages", "fetch error:"+err.Error())
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Uid < list[j].Uid
+	})
+	for _, msg := range list {
+		// stop between messages, the rest is fetched after the next start
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := ea.processMessage(msg, mbox.UidValidity); err != nil {
+			ea.sendEvent(model.Event{Level: LevelError, Method: "GetNewMessages", Uid: msg.Uid, Message: fmt.Sprintf("fetch uid %d error:%s", msg.Uid, err.Error())})
+			return err
+		}
+		ea.checkpoint.LastUid = msg.Uid
+		if err := ea.checkpoint.save(ea.checkpointFile); err != nil {
+			ea.sendError("GetNewMessages", "save checkpoint error:"+err.Error())
+		}
 	}
-	ea.sendMessage("GetLatestMessages", "done")
+	ea.advanceCheckpoint(searchedUid)
+	// failure actions of mails whose patterns didn't match
+	ea.applyActions()
+	ea.sendMessage("GetNewMessages", fmt.Sprintf("done, last uid %d", ea.checkpoint.LastUid))
 	return nil
 }
 
-func (ea *ReceiveApp) decodeEmail(message string) bool {
-	params := make([]model.Param, 0)
-	for _, content := range ea.config.ContentPatterns {
-		valReg, err := regexp.Compile(content.Regex)
-		if err != nil {
-			ea.sendMessage("GetLatestMessages", err.Error())
+// search runs the filter on the UIDs in seqset and returns the matching UIDs
+// above the checkpoint, nil when there are none
+func (ea *ReceiveApp) search(filter model.SearchFilter, seqset *imap.SeqSet) (*imap.SeqSet, error) {
+	criteria, err := SearchCriteria(filter, seqset)
+	if err != nil {
+		return nil, err
+	}
+	uids, err := ea.client.UidSearch(criteria)
+	if err != nil {
+		return nil, err
+	}
+	matched := new(imap.SeqSet)
+	count := 0
+	for _, uid := range uids {
+		if uid > ea.checkpoint.LastUid {
+			matched.AddNum(uid)
+			count++
 		}
-		matches := valReg.FindAllString(message, -1)
-		if content.Require && len(matches) == 0 {
-			return true
+	}
+	ea.sendMessage("Search", fmt.Sprintf("%d new messages match the filter", count))
+	if matched.Empty() {
+		return nil, nil
+	}
+	return matched, nil
+}
+
+// advanceCheckpoint moves the checkpoint to uid if it is behind
+func (ea *ReceiveApp) advanceCheckpoint(uid uint32) {
+	if uid <= ea.checkpoint.LastUid {
+		return
+	}
+	ea.checkpoint.LastUid = uid
+	if err := ea.checkpoint.save(ea.checkpointFile); err != nil {
+		ea.sendError("GetNewMessages", "save checkpoint error:"+err.Error())
+	}
+}
+
+// resync resets the checkpoint to the newest message of the mailbox, it runs on
+// the first start and whenever the server reports a new UIDVALIDITY
+func (ea *ReceiveApp) resync(mbox *imap.MailboxStatus) error {
+	if ea.checkpoint.UidValidity == 0 {
+		ea.sendMessage("Resync", fmt.Sprintf("no checkpoint found, start from current mailbox state (uidvalidity %d)", mbox.UidValidity))
+	} else {
+		ea.sendWarn("Resync", fmt.Sprintf("uidvalidity changed from %d to %d, saved uid %d is invalid, messages arrived during the change may be skipped",
+			ea.checkpoint.UidValidity, mbox.UidValidity, ea.checkpoint.LastUid))
+	}
+	lastUid := uint32(0)
+	if mbox.UidNext > 0 {
+		lastUid = mbox.UidNext - 1
+	} else if mbox.Messages > 0 {
+		// server didn't report UIDNEXT, ask for the UID of the last message
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(mbox.Messages)
+		messages := make(chan *imap.Message, 1)
+		if err := ea.client.Fetch(seqset, []imap.FetchItem{imap.FetchUid}, messages); err != nil {
+			return err
 		}
-		vals := make([]string, 0)
-		for _, m := range matches {
-			vals = append(vals, m)
+		for msg := range messages {
+			lastUid = msg.Uid
 		}
-		params = append(params, model.Param{
-			Name:  content.Param,
-			Value: vals,
-		})
 	}
-	ea.sendMessage("decodeEmail", fmt.Sprintf("%v", params))
-	ea.sendHttp(params)
-	return true
+	ea.checkpoint.UidValidity = mbox.UidValidity
+	ea.checkpoint.LastUid = lastUid
+	if err := ea.checkpoint.save(ea.checkpointFile); err != nil {
+		return err
+	}
+	ea.sendMessage("Resync", fmt.Sprintf("resync done, uidvalidity %d, last uid %d", mbox.UidValidity, lastUid))
+	return nil
 }
 
-func (ea *ReceiveApp) sendHttp(params []model.Param) error {
-	body := model.HttpBody{Params: params}
-	jsonData, err := json.Marshal(body)
-	ea.sendMessage("sendHttp: body ", string(jsonData))
-	if err != nil {
-		ea.sendMessage("sendHttp", err.Error())
-		return err
+// processMessage fetches the text of msg and queues its params, messages
+// larger than the max message size are skipped, an error means the message
+// should be tried again
+func (ea *ReceiveApp) processMessage(msg *imap.Message, uidValidity uint32) error {
+	source := &model.MessageRef{
+		Folder:      ea.config.EmailSettings.Folder,
+		UidValidity: uidValidity,
+		Uid:         msg.Uid,
+		Arrived:     msg.InternalDate.Unix(),
+	}
+	maxSize := ea.config.EmailSettings.MaxMessageSize
+	if maxSize > 0 && msg.Size > maxSize {
+		ea.sendForMessage(LevelWarn, "ProcessMessage", source, fmt.Sprintf("skip uid %d, size %d exceeds the max message size %d", msg.Uid, msg.Size, maxSize))
+		ea.addFailureAction(source)
+		return nil
+	}
+	if msg.BodyStructure != nil {
+		_, attachments := textPart(msg.BodyStructure)
+		for _, filename := range attachments {
+			ea.sendForMessage(LevelInfo, "ProcessMessage", source, fmt.Sprintf("Got attachment: %v (not downloaded)", filename))
+		}
+	}
+	r, err := fetchText(ea.client, msg.Uid, msg.BodyStructure)
+	if err == errMessageGone {
+		ea.sendForMessage(LevelWarn, "ProcessMessage", source, fmt.Sprintf("skip uid %d, %s", msg.Uid, err.Error()))
+		return nil
 	}
-	req, err := http.NewRequest("POST", ea.config.CallbackUrl, bytes.NewReader(jsonData))
 	if err != nil {
-		ea.sendMessage("sendHttp", err.Error())
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	client := http.Client{}
-	resp, err := client.Do(req)
+	queued, err := ea.deliverMail(r, ea.sender, source)
 	if err != nil {
-		ea.sendMessage("sendHttp", err.Error())
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		ea.sendMessage("sendHttp", "http status err")
-		return errors.New("http status err")
+	if !queued {
+		ea.addFailureAction(source)
+		return nil
+	}
+	if !msg.InternalDate.IsZero() {
+		ea.sendForMessage(LevelInfo, "ProcessMessage", source, fmt.Sprintf("uid %d queued %s after arrival", msg.Uid, latency(msg.InternalDate)))
 	}
-	respBody, err := ioutil.ReadAll(resp.Body)
-	ea.sendMessage("sendHttp: response ", string(respBody))
 	return nil
 }
+
+func (ea *ReceiveApp) addFailureAction(source *model.MessageRef) {
+	if ea.actions == nil || ActionEmpty(ea.config.EmailSettings.OnFailure) {
+		return
+	}
+	if err := ea.actions.Add(*source, false); err != nil {
+		ea.sendForMessage(LevelError, "ProcessMessage", source, "save action error:"+err.Error())
+	}
+}
+
+// applyActions runs the pending success and failure actions on the selected
+// folder, actions of another folder or UIDVALIDITY are dropped since their
+// UIDs mean nothing here, failed actions are kept for the next session until
+// they failed maxActionAttempts times
+func (ea *ReceiveApp) applyActions() {
+	if ea.actions == nil {
+		return
+	}
+	pending := ea.actions.List()
+	if len(pending) == 0 {
+		return
+	}
+	settings := ea.config.EmailSettings
+	done := make([]PendingAction, 0, len(pending))
+	succeeded, failed := new(imap.SeqSet), new(imap.SeqSet)
+	var succeededItems, failedItems []PendingAction
+	for _, item := range pending {
+		if item.Source.Folder != settings.Folder || item.Source.UidValidity != ea.checkpoint.UidValidity {
+			ea.sendForMessage(LevelWarn, "ApplyActions", &item.Source, fmt.Sprintf("drop action for uid %d of %s, the folder or uidvalidity changed", item.Source.Uid, item.Source.Folder))
+			done = append(done, item)
+			continue
+		}
+		if item.Success {
+			succeeded.AddNum(item.Source.Uid)
+			succeededItems = append(succeededItems, item)
+		} else {
+			failed.AddNum(item.Source.Uid)
+			failedItems = append(failedItems, item)
+		}
+	}
+	var retry []PendingAction
+	if ea.applyAction(succeeded, succeededItems, settings.OnSuccess, "success") {
+		done = append(done, succeededItems...)
+	} else {
+		retry = append(retry, succeededItems...)
+	}
+	if ea.applyAction(failed, failedItems, settings.OnFailure, "failure") {
+		done = append(done, failedItems...)
+	} else {
+		retry = append(retry, failedItems...)
+	}
+	dropped, err := ea.actions.Update(done, retry)
+	if err != nil {
+		ea.sendError("ApplyActions", "save actions error:"+err.Error())
+	}
+	for _, item := range dropped {
+		ea.sendForMessage(LevelError, "ApplyActions", &item.Source, fmt.Sprintf("drop action for uid %d, it failed %d times", item.Source.Uid, item.Attempts))
+	}
+}
+
+// applyAction returns false when the action failed and has to be retried
+func (ea *ReceiveApp) applyAction(uids *imap.SeqSet, items []PendingAction, action model.MessageAction, name string) bool {
+	if len(items) == 0 || ActionEmpty(action) {
+		return true
+	}
+	if err := applyAction(ea.client, uids, action); err != nil {
+		ea.sendEvent(model.Event{Level: LevelError, Method: "ApplyActions", Message: fmt.Sprintf("%s action on uid %s error:%s", name, uids, err.Error()), Fields: map[string]string{"uids": uids.String()}})
+		return false
+	}
+	ea.sendEvent(model.Event{Level: LevelInfo, Method: "ApplyActions", Message: fmt.Sprintf("%s action applied to uid %s", name, uids), Fields: map[string]string{"uids": uids.String()}})
+	return true
+}
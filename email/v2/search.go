@@ -0,0 +1,73 @@
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"github.com/emersion/go-imap"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// SinceLayout is the date format of SearchFilter.Since
+const SinceLayout = "2006-01-02"
+
+// FilterEmpty reports whether the filter has no criteria, then no SEARCH is
+// needed before the fetch
+func FilterEmpty(filter model.SearchFilter) bool {
+	return filter.From == "" && filter.To == "" && filter.Subject == "" && filter.Since == "" &&
+		!filter.Unseen && filter.Larger == 0 && filter.Smaller == 0 && len(filter.Headers) == 0
+}
+
+// ValidateFilter checks the date and header names of a filter
+func ValidateFilter(filter model.SearchFilter) error {
+	if filter.Since != "" {
+		if _, err := time.Parse(SinceLayout, filter.Since); err != nil {
+			return fmt.Errorf("invalid filter date %s, use YYYY-MM-DD", filter.Since)
+		}
+	}
+	if filter.Larger > 0 && filter.Smaller > 0 && filter.Larger >= filter.Smaller {
+		return errors.New("filter larger must be less than smaller")
+	}
+	for _, header := range filter.Headers {
+		name := strings.TrimSpace(header.Name)
+		if name == "" || strings.ContainsAny(name, ": \t") {
+			return errors.New("invalid filter header name " + header.Name)
+		}
+	}
+	return nil
+}
+
+// SearchCriteria turns the filter into a SEARCH for the UIDs in uids, the
+// text criteria are substring matches on the server, usually case-insensitive
+func SearchCriteria(filter model.SearchFilter, uids *imap.SeqSet) (*imap.SearchCriteria, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = uids
+	criteria.Header = make(textproto.MIMEHeader)
+	if filter.From != "" {
+		criteria.Header.Add("From", filter.From)
+	}
+	if filter.To != "" {
+		criteria.Header.Add("To", filter.To)
+	}
+	if filter.Subject != "" {
+		criteria.Header.Add("Subject", filter.Subject)
+	}
+	for _, header := range filter.Headers {
+		criteria.Header.Add(strings.TrimSpace(header.Name), header.Value)
+	}
+	if filter.Since != "" {
+		since, err := time.Parse(SinceLayout, filter.Since)
+		if err != nil {
+			return nil, err
+		}
+		criteria.Since = since
+	}
+	if filter.Unseen {
+		criteria.WithoutFlags = []string{imap.SeenFlag}
+	}
+	criteria.Larger = filter.Larger
+	criteria.Smaller = filter.Smaller
+	return criteria, nil
+}
@@ -0,0 +1,314 @@
+package v2
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"github.com/VirgilZhao/mailtohttp/signature"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	maxSendAttempts = 10
+	retryBaseDelay  = 5 * time.Second
+	retryMaxDelay   = 1 * time.Hour
+	sendCheckPeriod = 1 * time.Second
+)
+
+// SenderApp delivers callback bodies through a queue persisted on local disk,
+// failed deliveries are retried with exponential backoff and moved to the
+// dead letter file after maxSendAttempts
+type SenderApp struct {
+	App
+	queueFile  string
+	deadFile   string
+	items      []model.HttpSender
+	lock       sync.Mutex
+	notifyChan chan struct{}
+	drainChan  chan time.Time
+	// onFinish is called when a delivery with a source message was sent or
+	// moved to the dead letter file
+	onFinish func(source *model.MessageRef, delivered bool)
+}
+
+func NewSenderApp(config *model.ServiceConfig, msgChan chan string, queueFile, deadFile string) *SenderApp {
+	sa := &SenderApp{
+		App: App{
+			Name:    "SenderApp",
+			config:  config,
+			msgChan: msgChan,
+		},
+		queueFile:  queueFile,
+		deadFile:   deadFile,
+		items:      make([]model.HttpSender, 0),
+		notifyChan: make(chan struct{}, 1),
+		drainChan:  make(chan time.Time, 1),
+	}
+	sa.loadQueue()
+	return sa
+}
+
+// Enqueue stores the params on disk before returning, so the caller can treat
+// the mail as handled even if the callback endpoint is down
+func (sa *SenderApp) Enqueue(params []model.Param, source *model.MessageRef) error {
+	now := time.Now().Unix()
+	item := model.HttpSender{
+		Id:        newDeliveryId(),
+		Params:    params,
+		Timestamp: now,
+		NextRun:   now,
+		Source:    source,
+	}
+	sa.lock.Lock()
+	sa.items = append(sa.items, item)
+	err := sa.saveQueue()
+	sa.lock.Unlock()
+	if err != nil {
+		sa.sendForMessage(LevelError, "Enqueue", source, "save queue error:"+err.Error())
+		return err
+	}
+	sa.sendDelivery(LevelInfo, "Enqueue", item, fmt.Sprintf("delivery %s queued", item.Id))
+	select {
+	case sa.notifyChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start sends the due deliveries until ctx is cancelled, a request in flight
+// is cancelled too and tried again after the next start
+func (sa *SenderApp) Start(ctx context.Context) {
+	t := time.NewTicker(sendCheckPeriod)
+	defer t.Stop()
+	sa.sendMessage("Start", fmt.Sprintf("%d deliveries pending", sa.pending()))
+	for {
+		select {
+		case <-t.C:
+			sa.sendDue(ctx)
+		case <-sa.notifyChan:
+			sa.sendDue(ctx)
+		case deadline := <-sa.drainChan:
+			drainCtx, cancel := context.WithDeadline(ctx, deadline)
+			sa.sendDue(drainCtx)
+			cancel()
+			sa.sendMessage("Start", fmt.Sprintf("drained, %d deliveries left in queue", sa.pending()))
+			return
+		case <-ctx.Done():
+			sa.sendMessage("Start", "stop by signal")
+			return
+		}
+	}
+}
+
+// Drain makes Start send the due deliveries once more and return, a request
+// in flight is finished first. Requests still running at deadline are
+// cancelled and stay in the queue
+func (sa *SenderApp) Drain(deadline time.Time) {
+	select {
+	case sa.drainChan <- deadline:
+	default:
+	}
+}
+
+func (sa *SenderApp) pending() int {
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+	return len(sa.items)
+}
+
+// sendDue tries every item whose NextRun has passed, items are copied out of
+// the lock so Enqueue never waits for a slow callback endpoint
+func (sa *SenderApp) sendDue(ctx context.Context) {
+	now := time.Now().Unix()
+	sa.lock.Lock()
+	due := make([]model.HttpSender, 0)
+	for _, item := range sa.items {
+		if item.NextRun <= now {
+			due = append(due, item)
+		}
+	}
+	sa.lock.Unlock()
+	for _, item := range due {
+		err := sa.sendHttp(ctx, item)
+		if ctx.Err() != nil {
+			// stopped, the attempt doesn't count
+			return
+		}
+		sa.finish(item, err)
+	}
+}
+
+func (sa *SenderApp) finish(item model.HttpSender, sendErr error) {
+	sa.lock.Lock()
+	text, removed, err := sa.updateItem(item, sendErr)
+	sa.lock.Unlock()
+	if text != "" {
+		level := LevelInfo
+		if sendErr != nil && removed {
+			level = LevelError
+		} else if sendErr != nil {
+			level = LevelWarn
+		}
+		sa.sendDelivery(level, "Finish", item, text)
+	}
+	if err != nil {
+		sa.sendDelivery(LevelError, "Finish", item, err.Error())
+	}
+	if removed && item.Source != nil && sa.onFinish != nil {
+		sa.onFinish(item.Source, sendErr == nil)
+	}
+}
+
+// sendDelivery logs an event with the delivery id and the uid of the mail
+func (sa *SenderApp) sendDelivery(level, method string, item model.HttpSender, text string) {
+	e := model.Event{Level: level, Method: method, Message: text, Fields: map[string]string{"delivery": item.Id}}
+	if item.Source != nil {
+		e.Uid = item.Source.Uid
+		e.Fields["folder"] = item.Source.Folder
+	}
+	sa.sendEvent(e)
+}
+
+// updateItem must be called with lock held, it removes or reschedules the item
+// and returns the text to log and whether the item left the queue
+func (sa *SenderApp) updateItem(item model.HttpSender, sendErr error) (string, bool, error) {
+	index := -1
+	for i := range sa.items {
+		if sa.items[i].Id == item.Id {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return "", false, nil
+	}
+	text := ""
+	removed := false
+	if sendErr == nil {
+		removed = true
+		sa.items = append(sa.items[:index], sa.items[index+1:]...)
+		text = fmt.Sprintf("delivery %s sent after %d attempts", item.Id, item.Attempts+1)
+		if item.Source != nil && item.Source.Arrived > 0 {
+			text += fmt.Sprintf(", %s after the mail arrived", latency(time.Unix(item.Source.Arrived, 0)))
+		}
+	} else {
+		current := &sa.items[index]
+		current.Attempts++
+		current.LastError = sendErr.Error()
+		if current.Attempts >= maxSendAttempts {
+			if err := sa.deadLetter(*current); err != nil {
+				return "", false, errors.New("write dead letter error:" + err.Error())
+			}
+			removed = true
+			text = fmt.Sprintf("delivery %s failed %d times, moved to dead letter", current.Id, current.Attempts)
+			sa.items = append(sa.items[:index], sa.items[index+1:]...)
+		} else {
+			delay := retryDelay(current.Attempts)
+			current.NextRun = time.Now().Add(delay).Unix()
+			text = fmt.Sprintf("delivery %s attempt %d failed, retry in %v", current.Id, current.Attempts, delay)
+		}
+	}
+	if err := sa.saveQueue(); err != nil {
+		return text, removed, errors.New("save queue error:" + err.Error())
+	}
+	return text, removed, nil
+}
+
+func (sa *SenderApp) sendHttp(ctx context.Context, item model.HttpSender) error {
+	jsonData, err := CallbackBody(item.Params)
+	sa.sendDebug("sendHttp: body ", string(jsonData))
+	if err != nil {
+		sa.sendError("sendHttp", err.Error())
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", sa.config.CallbackUrl, bytes.NewReader(jsonData))
+	if err != nil {
+		sa.sendError("sendHttp", err.Error())
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sa.config.CallbackSecret != "" {
+		signature.SignRequest(req, []byte(sa.config.CallbackSecret), item.Id, jsonData)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		sa.sendWarn("sendHttp", err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	// any 2xx is delivered, a receiver may answer 201, 202 or 204
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		sa.sendWarn("sendHttp", fmt.Sprintf("http status err %d", resp.StatusCode))
+		return fmt.Errorf("http status err %d", resp.StatusCode)
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	sa.sendDebug("sendHttp: response ", string(respBody))
+	return nil
+}
+
+func (sa *SenderApp) loadQueue() {
+	bytes, err := ioutil.ReadFile(sa.queueFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		sa.sendError("LoadQueue", err.Error())
+		return
+	}
+	if err := json.Unmarshal(bytes, &sa.items); err != nil {
+		sa.sendError("LoadQueue", err.Error())
+	}
+}
+
+// saveQueue must be called with lock held
+func (sa *SenderApp) saveQueue() error {
+	bytes, err := json.Marshal(sa.items)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(sa.queueFile, bytes, 0666)
+}
+
+// deadLetter appends the item as one json line to the dead letter file
+func (sa *SenderApp) deadLetter(item model.HttpSender) error {
+	bytes, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(sa.deadFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(bytes, '\n'))
+	return err
+}
+
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= retryMaxDelay {
+			return retryMaxDelay
+		}
+	}
+	return delay
+}
+
+func newDeliveryId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,423 @@
+package v2
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	smtpCommandTimeout = 5 * time.Minute
+	smtpDataTimeout    = 10 * time.Minute
+	smtpMaxRecipients  = 100
+	smtpMaxLineLength  = 4096
+)
+
+var (
+	ErrSenderNotAllowed = errors.New("sender not allowed")
+	ErrPipelineStopped  = errors.New("pipeline is stopped")
+	// ErrServerClosed is returned by Serve after Close
+	ErrServerClosed = errors.New("smtp: server closed")
+)
+
+// MailTarget receives the mails SmtpServer routes to it by recipient
+type MailTarget interface {
+	// AllowSender returns ErrSenderNotAllowed or ErrPipelineStopped when the
+	// mail must be rejected
+	AllowSender(from string) error
+	Deliver(r io.Reader) error
+}
+
+// StoppedTarget stands for a pipeline that is configured for a recipient but
+// not running, the MTA gets a temporary failure and retries later
+type StoppedTarget struct{}
+
+func (StoppedTarget) AllowSender(from string) error {
+	return ErrPipelineStopped
+}
+
+func (StoppedTarget) Deliver(r io.Reader) error {
+	return ErrPipelineStopped
+}
+
+// SmtpServer accepts mails over SMTP (RFC 5321) or LMTP (RFC 2033) and hands
+// them to the MailTarget Route returns for each recipient. There is no AUTH
+// and no STARTTLS, it is meant to sit behind the local MTA
+type SmtpServer struct {
+	Addr    string
+	LMTP    bool
+	MaxSize int64
+	Route   func(rcpt string) MailTarget
+
+	listener net.Listener
+	closed   bool
+	lock     sync.Mutex
+}
+
+func (s *SmtpServer) protocol() string {
+	if s.LMTP {
+		return "LMTP"
+	}
+	return "SMTP"
+}
+
+func (s *SmtpServer) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *SmtpServer) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.lock.Unlock()
+	log.Printf("%s server listening on %s\n", s.protocol(), l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *SmtpServer) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// smtpSession is the state of one connection, recipients are grouped by
+// target so a mail for several addresses of one pipeline is delivered once
+type smtpSession struct {
+	server     *SmtpServer
+	conn       net.Conn
+	text       *textproto.Conn
+	helo       string
+	from       string
+	hasFrom    bool
+	rcpts      []string
+	rcptTarget []MailTarget
+}
+
+func (s *SmtpServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	session := &smtpSession{
+		server: s,
+		conn:   conn,
+		text:   textproto.NewConn(conn),
+	}
+	// the fixed size buffer bounds a command line, readLine fails once it is full
+	session.text.R = bufio.NewReaderSize(conn, smtpMaxLineLength+2)
+	session.reply(220, "mailtohttp "+s.protocol()+" ready")
+	for {
+		conn.SetReadDeadline(time.Now().Add(smtpCommandTimeout))
+		line, err := session.readLine()
+		if err != nil {
+			if err != io.EOF {
+				session.reply(421, "error reading command")
+			}
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		if !session.handle(strings.ToUpper(verb), arg) {
+			return
+		}
+	}
+}
+
+func (ss *smtpSession) readLine() (string, error) {
+	line, err := ss.text.R.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errors.New("line too long")
+	}
+	if err == io.EOF && len(line) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (ss *smtpSession) reply(code int, text string) {
+	ss.text.PrintfLine("%d %s", code, text)
+}
+
+func (ss *smtpSession) reset() {
+	ss.from = ""
+	ss.hasFrom = false
+	ss.rcpts = nil
+	ss.rcptTarget = nil
+}
+
+// handle runs one command, false ends the connection
+func (ss *smtpSession) handle(verb, arg string) bool {
+	lmtp := ss.server.LMTP
+	switch verb {
+	case "HELO", "EHLO", "LHLO":
+		if lmtp != (verb == "LHLO") {
+			ss.reply(500, "use LHLO for LMTP and HELO/EHLO for SMTP")
+			return true
+		}
+		if arg == "" {
+			ss.reply(501, "domain required")
+			return true
+		}
+		ss.helo = arg
+		ss.reset()
+		if verb == "HELO" {
+			ss.reply(250, "mailtohttp")
+			return true
+		}
+		ss.text.PrintfLine("250-mailtohttp")
+		ss.text.PrintfLine("250-PIPELINING")
+		ss.text.PrintfLine("250-8BITMIME")
+		ss.text.PrintfLine("250 SIZE %d", ss.server.MaxSize)
+	case "MAIL":
+		ss.mail(arg)
+	case "RCPT":
+		ss.rcpt(arg)
+	case "DATA":
+		ss.data()
+	case "RSET":
+		ss.reset()
+		ss.reply(250, "ok")
+	case "NOOP":
+		ss.reply(250, "ok")
+	case "VRFY":
+		ss.reply(252, "cannot verify user")
+	case "QUIT":
+		ss.reply(221, "bye")
+		return false
+	default:
+		ss.reply(502, "command not implemented")
+	}
+	return true
+}
+
+func (ss *smtpSession) mail(arg string) {
+	if ss.helo == "" {
+		ss.reply(503, "send HELO first")
+		return
+	}
+	if ss.hasFrom {
+		ss.reply(503, "nested MAIL command")
+		return
+	}
+	if !strings.HasPrefix(strings.ToUpper(arg), "FROM:") {
+		ss.reply(501, "syntax: MAIL FROM:<address>")
+		return
+	}
+	from, params, err := parsePath(arg[len("FROM:"):])
+	if err != nil {
+		ss.reply(501, err.Error())
+		return
+	}
+	for _, param := range params {
+		if strings.HasPrefix(strings.ToUpper(param), "SIZE=") {
+			size, err := strconv.ParseInt(param[len("SIZE="):], 10, 64)
+			if err != nil {
+				ss.reply(501, "invalid SIZE")
+				return
+			}
+			if size > ss.server.MaxSize {
+				ss.reply(552, "message size exceeds fixed maximum message size")
+				return
+			}
+		}
+	}
+	ss.from = from
+	ss.hasFrom = true
+	ss.reply(250, "ok")
+}
+
+func (ss *smtpSession) rcpt(arg string) {
+	if !ss.hasFrom {
+		ss.reply(503, "send MAIL first")
+		return
+	}
+	if !strings.HasPrefix(strings.ToUpper(arg), "TO:") {
+		ss.reply(501, "syntax: RCPT TO:<address>")
+		return
+	}
+	rcpt, _, err := parsePath(arg[len("TO:"):])
+	if err != nil || rcpt == "" {
+		ss.reply(501, "invalid recipient")
+		return
+	}
+	if len(ss.rcpts) >= smtpMaxRecipients {
+		ss.reply(452, "too many recipients")
+		return
+	}
+	target := ss.server.Route(rcpt)
+	if target == nil {
+		ss.reply(550, "no pipeline for recipient "+rcpt)
+		return
+	}
+	if err := target.AllowSender(ss.from); err != nil {
+		if err == ErrPipelineStopped {
+			ss.reply(450, err.Error())
+		} else {
+			ss.reply(550, err.Error())
+		}
+		return
+	}
+	ss.rcpts = append(ss.rcpts, rcpt)
+	ss.rcptTarget = append(ss.rcptTarget, target)
+	ss.reply(250, "ok")
+}
+
+func (ss *smtpSession) data() {
+	if len(ss.rcpts) == 0 {
+		ss.reply(503, "send RCPT first")
+		return
+	}
+	ss.reply(354, "end data with <CR><LF>.<CR><LF>")
+	ss.conn.SetReadDeadline(time.Now().Add(smtpDataTimeout))
+	dr := ss.text.DotReader()
+	raw, err := ioutil.ReadAll(io.LimitReader(dr, ss.server.MaxSize+1))
+	if err != nil {
+		ss.reply(451, "error reading data")
+		ss.reset()
+		return
+	}
+	if int64(len(raw)) > ss.server.MaxSize {
+		// consume the rest so the connection stays usable
+		io.Copy(ioutil.Discard, dr)
+		ss.replyAll(552, "message size exceeds fixed maximum message size")
+		ss.reset()
+		return
+	}
+	results := make(map[MailTarget]error)
+	for _, target := range ss.rcptTarget {
+		if _, ok := results[target]; ok {
+			continue
+		}
+		results[target] = target.Deliver(bytes.NewReader(raw))
+	}
+	if ss.server.LMTP {
+		// LMTP answers once per recipient
+		for i, rcpt := range ss.rcpts {
+			if err := results[ss.rcptTarget[i]]; err != nil {
+				ss.reply(451, fmt.Sprintf("<%s> %s", rcpt, err.Error()))
+			} else {
+				ss.reply(250, fmt.Sprintf("<%s> ok", rcpt))
+			}
+		}
+	} else {
+		// a single reply can't report partial success, the MTA retries and
+		// the pipelines that already have the mail get it twice
+		var failed error
+		for _, err := range results {
+			if err != nil {
+				failed = err
+			}
+		}
+		if failed != nil {
+			ss.reply(451, failed.Error())
+		} else {
+			ss.reply(250, "ok")
+		}
+	}
+	ss.reset()
+}
+
+// replyAll sends the same reply once for SMTP or once per recipient for LMTP
+func (ss *smtpSession) replyAll(code int, text string) {
+	if !ss.server.LMTP {
+		ss.reply(code, text)
+		return
+	}
+	for range ss.rcpts {
+		ss.reply(code, text)
+	}
+}
+
+// parsePath parses "<address> PARAM=VALUE ...", the null path "<>" returns an
+// empty address
+func parsePath(s string) (string, []string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "<") {
+		return "", nil, errors.New("address must be enclosed in <>")
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 0 {
+		return "", nil, errors.New("address must be enclosed in <>")
+	}
+	address := s[1:end]
+	// drop a source route like "@a,@b:user@c"
+	if i := strings.LastIndexByte(address, ':'); i >= 0 && strings.HasPrefix(address, "@") {
+		address = address[i+1:]
+	}
+	return address, strings.Fields(s[end+1:]), nil
+}
+
+// MatchAddress reports whether address is in list, an entry "@example.org"
+// matches every address of that domain, the comparison ignores case
+func MatchAddress(list []string, address string) bool {
+	return matchAddress(list, address, false)
+}
+
+// AcceptsRecipient reports whether mails pushed to rcpt belong to a pipeline
+// with config, with exact only full addresses count, not "@domain" entries
+func AcceptsRecipient(config *model.ServiceConfig, rcpt string, exact bool) bool {
+	settings := config.EmailSettings
+	return settings.SourceType == SourceSMTP && matchAddress(settings.Recipients, rcpt, exact)
+}
+
+func matchAddress(list []string, address string, exact bool) bool {
+	address = strings.ToLower(address)
+	for _, entry := range list {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if strings.HasPrefix(entry, "@") {
+			if !exact && strings.HasSuffix(address, entry) {
+				return true
+			}
+		} else if entry == address {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidAddressEntry checks an entry of a recipient or sender list
+func ValidAddressEntry(entry string) bool {
+	entry = strings.TrimSpace(entry)
+	at := strings.IndexByte(entry, '@')
+	return at >= 0 && at == strings.LastIndexByte(entry, '@') && at < len(entry)-1 && !strings.ContainsAny(entry, " <>")
+}
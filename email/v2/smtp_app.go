@@ -0,0 +1,67 @@
+package v2
+
+import (
+	"fmt"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"io"
+	"sync"
+)
+
+// SmtpApp takes the mails SmtpServer routes to its pipeline, it has no loop
+// of its own, the server calls Deliver on the connection goroutine
+type SmtpApp struct {
+	App
+	sender  Enqueuer
+	stopped bool
+	lock    sync.Mutex
+}
+
+func NewSmtpApp(config *model.ServiceConfig, msgChan chan string, sender Enqueuer) *SmtpApp {
+	return &SmtpApp{
+		App: App{
+			Name:    "SmtpApp",
+			config:  config,
+			msgChan: msgChan,
+		},
+		sender: sender,
+	}
+}
+
+func (sa *SmtpApp) Start() {
+	sa.setState(StateIdling, nil)
+	sa.sendMessage("Start", fmt.Sprintf("accept mails for %v", sa.config.EmailSettings.Recipients))
+}
+
+func (sa *SmtpApp) Stop() {
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+	if sa.stopped {
+		return
+	}
+	sa.stopped = true
+	sa.setState(StateStopped, nil)
+	sa.sendMessage("Stop", "stop accepting mails")
+}
+
+// AllowSender checks the envelope sender against the allowlist, an empty
+// allowlist accepts every sender
+func (sa *SmtpApp) AllowSender(from string) error {
+	allowed := sa.config.EmailSettings.AllowedSenders
+	if len(allowed) == 0 || MatchAddress(allowed, from) {
+		return nil
+	}
+	sa.sendWarn("AllowSender", "reject sender <"+from+">")
+	return ErrSenderNotAllowed
+}
+
+func (sa *SmtpApp) Deliver(r io.Reader) error {
+	sa.lock.Lock()
+	stopped := sa.stopped
+	sa.lock.Unlock()
+	if stopped {
+		return ErrPipelineStopped
+	}
+	sa.sendMessage("Deliver", "new mail")
+	_, err := sa.deliverMail(r, sa.sender, nil)
+	return err
+}
@@ -0,0 +1,166 @@
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"github.com/emersion/go-imap/client"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// states a worker goes through, the current one is shown in the status API
+const (
+	StateConnecting     = "connecting"
+	StateAuthenticating = "authenticating"
+	StateIdling         = "idling"
+	StateFetching       = "fetching"
+	StateBackoff        = "backoff"
+	StateStopped        = "stopped"
+)
+
+const (
+	backoffBase = 1 * time.Second
+	backoffMax  = 5 * time.Minute
+)
+
+// AuthError is a login the server rejected, retrying with the same
+// credentials won't help so the worker stops instead
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return "authentication failed: " + e.Err.Error()
+}
+
+func isAuthError(err error) bool {
+	_, ok := err.(*AuthError)
+	return ok
+}
+
+// connectionError reports whether err came from the connection rather than
+// from a NO or BAD reply of the server
+func connectionError(c *client.Client, err error) bool {
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	select {
+	case <-c.LoggedOut():
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff returns exponentially growing delays up to backoffMax, each delay
+// is randomized between half and the full value so workers of several
+// pipelines don't reconnect at the same moment
+type backoff struct {
+	attempt uint
+}
+
+func (b *backoff) next() time.Duration {
+	delay := backoffMax
+	if b.attempt < 16 {
+		if d := backoffBase << b.attempt; d < backoffMax {
+			delay = d
+		}
+	}
+	b.attempt++
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// setState records the current state of the worker and sends it to the web
+// page when it changed, err is kept as the reason until the next state
+func (a *App) setState(state string, err error) {
+	errText := ""
+	if err != nil {
+		errText = err.Error()
+	}
+	a.stateLock.Lock()
+	changed := a.state != state || a.stateError != errText
+	a.state = state
+	a.stateError = errText
+	if changed {
+		a.stateSince = time.Now()
+	}
+	a.stateLock.Unlock()
+	if changed {
+		a.sendSocket("state", a.Name+":"+state)
+	}
+}
+
+// stopped sets StateStopped when the worker returns, an error set before,
+// like a rejected login, is kept
+func (a *App) stopped() {
+	a.stateLock.Lock()
+	state := a.state
+	a.stateLock.Unlock()
+	if state != StateStopped {
+		a.setState(StateStopped, nil)
+	}
+}
+
+func (a *App) State() model.WorkerStatus {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+	status := model.WorkerStatus{
+		Name:  a.Name,
+		State: a.state,
+		Error: a.stateError,
+	}
+	if !a.stateSince.IsZero() {
+		status.Since = a.stateSince.Unix()
+	}
+	return status
+}
+
+// inLogin reports whether the worker is still trying to log in
+func (a *App) inLogin() bool {
+	switch a.State().State {
+	case StateConnecting, StateAuthenticating, StateBackoff:
+		return true
+	}
+	return false
+}
+
+// wait sleeps for delay in StateBackoff with err as the reason, false means
+// ctx was cancelled
+func (a *App) wait(ctx context.Context, delay time.Duration, err error) bool {
+	a.setState(StateBackoff, err)
+	a.sendWarn("backoff", "retry in "+delay.Round(time.Millisecond).String())
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// alert shows text as a notification on the web page, it is logged as an
+// error event
+func (a *App) alert(text string) {
+	a.publishEvent("alert", model.Event{Level: LevelError, Method: "alert", Message: text})
+}
+
+func (a *App) sendSocket(msgType, text string) {
+	data := model.SocketMessage{
+		MsgType:  msgType,
+		Pipeline: a.config.Name,
+		Data:     text,
+	}
+	bytes, err := json.Marshal(&data)
+	if err != nil {
+		return
+	}
+	publish(a.msgChan, string(bytes))
+}
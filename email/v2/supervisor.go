@@ -0,0 +1,114 @@
+package v2
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// supervisor runs a group of workers in goroutines sharing one context.
+// Start and Stop may be called any number of times from any goroutine, Stop
+// cancels the context and waits for every worker to return. A new group is
+// only started once every worker of the last one has returned
+type supervisor struct {
+	name   string
+	lock   sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSupervisor(name string) *supervisor {
+	return &supervisor{name: name}
+}
+
+// Start runs workers unless a group is running, also a stopped one that
+// hasn't returned yet, it reports whether they were started
+func (s *supervisor) Start(workers ...func(ctx context.Context)) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.running() {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(len(workers))
+	for _, worker := range workers {
+		go func(worker func(ctx context.Context)) {
+			defer wg.Done()
+			worker(ctx)
+		}(worker)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	s.cancel = cancel
+	s.done = done
+	return true
+}
+
+// Stop cancels the running group and waits up to timeout for it, false means
+// a worker is still busy, it returns on its own once it sees the cancelled
+// context. A second Stop during the wait waits for the same group
+func (s *supervisor) Stop(timeout time.Duration) bool {
+	s.lock.Lock()
+	cancel, done := s.cancel, s.done
+	s.cancel = nil
+	s.lock.Unlock()
+	if done == nil {
+		return true
+	}
+	if cancel != nil {
+		cancel()
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		log.Println(s.name + " did not stop in time")
+		return false
+	}
+}
+
+// Running reports whether a worker of the last group hasn't returned yet
+func (s *supervisor) Running() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.running()
+}
+
+// running must be called with lock held
+func (s *supervisor) running() bool {
+	if s.done == nil {
+		return false
+	}
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Wait waits up to timeout for the running group to return on its own, it
+// reports whether no group is running anymore
+func (s *supervisor) Wait(timeout time.Duration) bool {
+	s.lock.Lock()
+	done := s.done
+	s.lock.Unlock()
+	if done == nil {
+		return true
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
@@ -0,0 +1,97 @@
+package v2
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingWorker returns once ctx is cancelled and counts the workers running
+func blockingWorker(running *int32) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		atomic.AddInt32(running, 1)
+		defer atomic.AddInt32(running, -1)
+		<-ctx.Done()
+	}
+}
+
+func TestSupervisorStartStop(t *testing.T) {
+	s := newSupervisor("test")
+	var running int32
+	if !s.Start(blockingWorker(&running), blockingWorker(&running)) {
+		t.Fatal("first Start refused")
+	}
+	if s.Start(blockingWorker(&running)) {
+		t.Fatal("second Start started a group while one is running")
+	}
+	if !s.Stop(time.Second) {
+		t.Fatal("Stop timed out")
+	}
+	if n := atomic.LoadInt32(&running); n != 0 {
+		t.Fatalf("%d workers still running after Stop", n)
+	}
+	if !s.Stop(time.Second) {
+		t.Fatal("second Stop timed out")
+	}
+	if s.Running() {
+		t.Fatal("Running after Stop")
+	}
+}
+
+func TestSupervisorStartWhileStopping(t *testing.T) {
+	s := newSupervisor("test")
+	release := make(chan struct{})
+	s.Start(func(ctx context.Context) {
+		<-ctx.Done()
+		<-release
+	})
+	if s.Stop(10 * time.Millisecond) {
+		t.Fatal("Stop returned true while the worker is busy")
+	}
+	var running int32
+	if s.Start(blockingWorker(&running)) {
+		t.Fatal("Start started a second group while the stopped one is running")
+	}
+	if !s.Running() {
+		t.Fatal("not Running while the worker is busy")
+	}
+	close(release)
+	if !s.Wait(time.Second) {
+		t.Fatal("worker did not return")
+	}
+	if !s.Start(blockingWorker(&running)) {
+		t.Fatal("Start refused after the old group returned")
+	}
+	if !s.Stop(time.Second) {
+		t.Fatal("Stop timed out")
+	}
+}
+
+func TestSupervisorConcurrent(t *testing.T) {
+	s := newSupervisor("test")
+	var running int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if s.Start(blockingWorker(&running), blockingWorker(&running)) {
+					if n := atomic.LoadInt32(&running); n > 2 {
+						t.Errorf("%d workers running, two groups at once", n)
+					}
+				}
+				s.Stop(time.Second)
+			}
+		}()
+	}
+	wg.Wait()
+	if !s.Stop(time.Second) {
+		t.Fatal("Stop timed out")
+	}
+	if n := atomic.LoadInt32(&running); n != 0 {
+		t.Fatalf("%d workers still running", n)
+	}
+}
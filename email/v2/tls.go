@@ -0,0 +1,83 @@
+package v2
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// BuildTLSConfig turns the TLS settings of a pipeline into a tls.Config for
+// host. When a fingerprint is pinned the server certificate must match it,
+// without a CA bundle the pin replaces the CA chain check so self-signed
+// certificates can be used
+func BuildTLSConfig(host string, settings *model.TLSSettings) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+	if settings == nil {
+		return config, nil
+	}
+	if settings.ServerName != "" {
+		config.ServerName = settings.ServerName
+	}
+	if settings.MinVersion != "" {
+		version, ok := tlsVersions[settings.MinVersion]
+		if !ok {
+			return nil, errors.New("invalid minimum TLS version " + settings.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	if settings.CaBundle != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(settings.CaBundle)) {
+			return nil, errors.New("no certificate found in CA bundle")
+		}
+		config.RootCAs = pool
+	}
+	if settings.ClientCert != "" || settings.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(settings.ClientCert), []byte(settings.ClientKey))
+		if err != nil {
+			return nil, errors.New("invalid client certificate: " + err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if settings.PinnedSha256 != "" {
+		pin, err := parseFingerprint(settings.PinnedSha256)
+		if err != nil {
+			return nil, err
+		}
+		if settings.CaBundle == "" {
+			config.InsecureSkipVerify = true
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if hex.EncodeToString(sum[:]) != pin {
+				return errors.New("server certificate fingerprint " + hex.EncodeToString(sum[:]) + " doesn't match the pinned fingerprint")
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// parseFingerprint accepts hex with or without colons, in any case
+func parseFingerprint(fingerprint string) (string, error) {
+	pin := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+	b, err := hex.DecodeString(pin)
+	if err != nil || len(b) != sha256.Size {
+		return "", errors.New("pinned fingerprint must be a hex SHA-256 hash")
+	}
+	return pin, nil
+}
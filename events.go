@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	v2 "github.com/VirgilZhao/mailtohttp/email/v2"
+	"github.com/VirgilZhao/mailtohttp/model"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	eventFileName = "events.log"
+	// largest page of the event query API
+	maxEventQueryLimit = 1000
+)
+
+// eventStore appends the events as json lines to events.log in dir, the file
+// is rotated to events.log.1 when it reaches maxSize and maxFiles rotated
+// files are kept. Seq numbers go on across restarts and rotations
+type eventStore struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	seq      uint64
+}
+
+// eventQuery filters the events, zero values match everything. From and To
+// are unix milliseconds, Level is the lowest level returned and Before the
+// Seq where the previous page ended
+type eventQuery struct {
+	From     int64
+	To       int64
+	Level    string
+	Pipeline string
+	Text     string
+	Before   uint64
+	Limit    int
+}
+
+func newEventStore(dir string, maxSize int64, maxFiles int) (*eventStore, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	s := &eventStore{dir: dir, maxSize: maxSize, maxFiles: maxFiles}
+	// the newest file with an event has the last seq
+	for i := 0; i <= maxFiles && s.seq == 0; i++ {
+		err := s.scanFile(s.fileName(i), func(e *model.Event) bool {
+			if e.Seq > s.seq {
+				s.seq = e.Seq
+			}
+			return true
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *eventStore) fileName(i int) string {
+	name := filepath.Join(s.dir, eventFileName)
+	if i > 0 {
+		name += fmt.Sprintf(".%d", i)
+	}
+	return name
+}
+
+// open must be called with lock held
+func (s *eventStore) open() error {
+	f, err := os.OpenFile(s.fileName(0), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.size = info.Size()
+	if s.size > 0 && !endsWithNewline(s.fileName(0)) {
+		// the last line was cut off by a crash, keep it apart from the next
+		n, err := f.Write([]byte{'\n'})
+		s.size += int64(n)
+		return err
+	}
+	return nil
+}
+
+func endsWithNewline(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	last := make([]byte, 1)
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return true
+	}
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return true
+	}
+	return last[0] == '\n'
+}
+
+// Append gives e the next seq and writes it
+func (s *eventStore) Append(e *model.Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return errors.New("event log file is not open")
+	}
+	s.seq++
+	e.Seq = s.seq
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if s.size > 0 && s.size+int64(len(bytes))+1 > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(append(bytes, '\n'))
+	s.size += int64(n)
+	return err
+}
+
+// rotate must be called with lock held, the oldest file is dropped
+func (s *eventStore) rotate() error {
+	if err := s.file.Close(); err != nil {
+		log.Println(err)
+	}
+	s.file = nil
+	os.Remove(s.fileName(s.maxFiles))
+	for i := s.maxFiles - 1; i >= 0; i-- {
+		if err := os.Rename(s.fileName(i), s.fileName(i+1)); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+	return s.open()
+}
+
+// Query returns the newest events matching q, at most q.Limit, and whether
+// there are older ones. The files are read newest first, a file is read up to
+// q.Before and an older file only while the page isn't full, then just until
+// one more match shows there are older events
+func (s *eventStore) Query(q eventQuery) ([]model.Event, bool, error) {
+	if q.Limit <= 0 || q.Limit > maxEventQueryLimit {
+		q.Limit = maxEventQueryLimit
+	}
+	minRank := v2.LevelRank(q.Level)
+	text := strings.ToLower(q.Text)
+	match := func(e *model.Event) bool {
+		if (q.From > 0 && e.Time < q.From) || (q.To > 0 && e.Time > q.To) {
+			return false
+		}
+		if v2.LevelRank(e.Level) < minRank {
+			return false
+		}
+		if q.Pipeline != "" && e.Pipeline != q.Pipeline {
+			return false
+		}
+		return text == "" || strings.Contains(strings.ToLower(e.Component+"-"+e.Method+":"+e.Message), text)
+	}
+	// the files are opened with lock held so a rotation can't move them
+	// while they are read, events.log is read up to its current size
+	s.lock.Lock()
+	files := make([]io.Reader, 0, s.maxFiles+1)
+	for i := 0; i <= s.maxFiles; i++ {
+		f, err := os.Open(s.fileName(i))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		if i == 0 {
+			files = append(files, io.LimitReader(f, s.size))
+		} else {
+			files = append(files, f)
+		}
+	}
+	s.lock.Unlock()
+	events := make([]model.Event, 0)
+	for _, f := range files {
+		need := q.Limit - len(events)
+		if need == 0 {
+			// the page is full, one match in an older file means more
+			more := false
+			err := readEvents(f, func(e *model.Event) bool {
+				if q.Before > 0 && e.Seq >= q.Before {
+					return false
+				}
+				more = match(e)
+				return !more
+			})
+			if err != nil {
+				return nil, false, err
+			}
+			if more {
+				return events, true, nil
+			}
+			continue
+		}
+		// events of one file are in order, the page is taken from its end,
+		// only the newest need+1 matches are kept
+		matched := make([]model.Event, 0)
+		err := readEvents(f, func(e *model.Event) bool {
+			if q.Before > 0 && e.Seq >= q.Before {
+				return false
+			}
+			if match(e) {
+				matched = append(matched, *e)
+				if len(matched) > 2*(need+1) {
+					matched = append(matched[:0], matched[len(matched)-need-1:]...)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		for i := len(matched) - 1; i >= 0; i-- {
+			if len(events) == q.Limit {
+				return events, true, nil
+			}
+			events = append(events, matched[i])
+		}
+	}
+	return events, false, nil
+}
+
+func (s *eventStore) scanFile(name string, fn func(e *model.Event) bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readEvents(f, fn)
+}
+
+// readEvents calls fn for every event in r until it returns false, lines that
+// aren't events, like one cut off by a crash, are skipped
+func readEvents(r io.Reader, fn func(e *model.Event) bool) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			e := model.Event{}
+			if json.Unmarshal(line, &e) == nil && e.Seq > 0 {
+				if !fn(&e) {
+					return nil
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -5,7 +5,9 @@ go 1.16
 require (
 	github.com/emersion/go-imap v1.0.6
 	github.com/emersion/go-imap-idle v0.0.0-20201224103203-6f42b9020098
-	github.com/emersion/go-message v0.11.1 // indirect
+	github.com/emersion/go-message v0.11.1
+	github.com/emersion/go-sasl v0.0.0-20191210011802-430746ea8b9b
 	github.com/gorilla/websocket v1.4.2
 	github.com/labstack/echo/v4 v4.2.1
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
 )
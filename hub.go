@@ -0,0 +1,144 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// messages a client may fall behind before it is dropped
+	hubClientBuffer = 256
+	hubWriteTimeout = 10 * time.Second
+)
+
+// logHub broadcasts the socket messages to every connected page, each client
+// has its own queue and writer so a slow client can't hold up the others or
+// the workers. The last log lines are kept and replayed to new clients
+type logHub struct {
+	lock    sync.Mutex
+	clients map[*hubClient]struct{}
+	history []string
+	replay  int
+	closed  bool
+}
+
+type hubClient struct {
+	conn *websocket.Conn
+	send chan string
+}
+
+func newLogHub(replay int) *logHub {
+	if replay < 0 {
+		replay = 0
+	}
+	return &logHub{
+		clients: make(map[*hubClient]struct{}),
+		history: make([]string, 0, replay),
+		replay:  replay,
+	}
+}
+
+// publish never blocks, a client whose queue is full is dropped, the page
+// reconnects and gets the replay
+func (h *logHub) publish(msgType, msg string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	// status, state and alert messages are stale on replay, the page loads
+	// the pipeline list itself
+	if msgType == "message" && h.replay > 0 {
+		if len(h.history) == h.replay {
+			h.history = append(h.history[:0], h.history[1:]...)
+		}
+		h.history = append(h.history, msg)
+	}
+	for c := range h.clients {
+		select {
+		case c.send <- msg:
+		default:
+			log.Println("websocket client " + c.conn.RemoteAddr().String() + " is too slow, dropped")
+			h.removeLocked(c)
+		}
+	}
+}
+
+// add registers conn and queues the replay before any new message, so the
+// client sees every line once and in order
+func (h *logHub) add(conn *websocket.Conn) {
+	c := &hubClient{
+		conn: conn,
+		send: make(chan string, h.replay+hubClientBuffer),
+	}
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		conn.Close()
+		return
+	}
+	for _, msg := range h.history {
+		c.send <- msg
+	}
+	h.clients[c] = struct{}{}
+	h.lock.Unlock()
+	go h.writer(c)
+	go h.reader(c)
+}
+
+func (h *logHub) remove(c *hubClient) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.removeLocked(c)
+}
+
+// removeLocked must be called with lock held, closing send makes the writer
+// close the connection
+func (h *logHub) removeLocked(c *hubClient) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	close(c.send)
+}
+
+func (h *logHub) writer(c *hubClient) {
+	defer c.conn.Close()
+	for msg := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(hubWriteTimeout))
+		if err := c.conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			log.Println(err)
+			h.remove(c)
+			// drain until remove closed send
+			for range c.send {
+			}
+			return
+		}
+	}
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+// reader notices the page going away, the page sends nothing we need
+func (h *logHub) reader(c *hubClient) {
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			h.remove(c)
+			return
+		}
+	}
+}
+
+func (h *logHub) count() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.clients)
+}
+
+// Close disconnects every client and refuses new ones
+func (h *logHub) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	for c := range h.clients {
+		h.removeLocked(c)
+	}
+}
@@ -1,33 +1,145 @@
 package model
 
 type EmailSettings struct {
-	ImapAddress string `json:"imapAddress"`
-	ImapPort    int    `json:"imapPort"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
+	ImapAddress           string         `json:"imapAddress"`
+	ImapPort              int            `json:"imapPort"`
+	Email                 string         `json:"email"`
+	Password              string         `json:"password"`
+	Folder                string         `json:"folder"`
+	Security              string         `json:"security"`
+	SourceType            string         `json:"sourceType"`
+	DeleteAfterProcessing bool           `json:"deleteAfterProcessing"`
+	PollInterval          int            `json:"pollInterval"`
+	Path                  string         `json:"path"`
+	Filter                SearchFilter   `json:"filter"`
+	MaxMessageSize        uint32         `json:"maxMessageSize"`
+	OnSuccess             MessageAction  `json:"onSuccess"`
+	OnFailure             MessageAction  `json:"onFailure"`
+	Recipients            []string       `json:"recipients"`
+	AllowedSenders        []string       `json:"allowedSenders"`
+	TLS                   *TLSSettings   `json:"-"`
+	AuthType              string         `json:"-"`
+	OAuth                 *OAuthSettings `json:"-"`
+}
+
+// SearchFilter limits the IMAP messages that are fetched, every set field
+// must match
+type SearchFilter struct {
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Subject string         `json:"subject"`
+	Since   string         `json:"since"`
+	Unseen  bool           `json:"unseen"`
+	Larger  uint32         `json:"larger"`
+	Smaller uint32         `json:"smaller"`
+	Headers []HeaderFilter `json:"headers"`
+}
+
+type HeaderFilter struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// MessageAction is applied to the IMAP message after its callback was
+// delivered (OnSuccess) or when extraction or delivery failed (OnFailure)
+type MessageAction struct {
+	Seen    bool   `json:"seen"`
+	Keyword string `json:"keyword"`
+	CopyTo  string `json:"copyTo"`
+	MoveTo  string `json:"moveTo"`
+	Delete  bool   `json:"delete"`
+}
+
+// MessageRef identifies the IMAP message a delivery came from, Arrived is
+// its INTERNALDATE in unix seconds
+type MessageRef struct {
 	Folder      string `json:"folder"`
+	UidValidity uint32 `json:"uidValidity"`
+	Uid         uint32 `json:"uid"`
+	Arrived     int64  `json:"arrived,omitempty"`
+}
+
+type TLSSettings struct {
+	CaBundle     string `json:"caBundle"`
+	ClientCert   string `json:"clientCert"`
+	ClientKey    string `json:"clientKey"`
+	HasClientKey bool   `json:"hasClientKey"`
+	PinnedSha256 string `json:"pinnedSha256"`
+	ServerName   string `json:"serverName"`
+	MinVersion   string `json:"minVersion"`
 }
 
 type ServiceContentPattern struct {
-	Param string `json:"param"`
-	Regex string `json:"regex"`
-	Require bool `json:"require"`
+	Param   string `json:"param"`
+	Regex   string `json:"regex"`
+	Require bool   `json:"require"`
+	Target  string `json:"target"`
+	Group   string `json:"group"`
 }
 
 type ServiceConfig struct {
+	Name            string                  `json:"name"`
 	EmailSettings   EmailSettings           `json:"emailSettings"`
 	ContentPatterns []ServiceContentPattern `json:"contentPatterns"`
 	CallbackUrl     string                  `json:"callbackUrl"`
+	CallbackSecret  string                  `json:"callbackSecret"`
+}
+
+type PipelineInfo struct {
+	Config  ServiceConfig  `json:"config"`
+	Status  string         `json:"status"`
+	Workers []WorkerStatus `json:"workers"`
+	// AutoStart is set when the pipeline was started last, it is started
+	// again when the service boots
+	AutoStart bool `json:"autoStart"`
+}
+
+// WorkerStatus is the state of one worker of a running pipeline, Error is
+// why it stopped or is backing off, Since is unix seconds
+type WorkerStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+	Since int64  `json:"since"`
+}
+
+type LoginBody struct {
+	Password string `json:"password"`
 }
 
 type LoginResponse struct {
-	Login  string        `json:"login"`
-	Config ServiceConfig `json:"config"`
+	Login     string         `json:"login"`
+	Token     string         `json:"token"`
+	Pipelines []PipelineInfo `json:"pipelines"`
 }
 
 type SocketMessage struct {
-	MsgType string `json:"msg_type"`
-	Data    string `json:"data"`
+	MsgType  string `json:"msg_type"`
+	Pipeline string `json:"pipeline"`
+	Data     string `json:"data"`
+	// Event is set for log lines, Data keeps the text for older pages
+	Event *Event `json:"event,omitempty"`
+}
+
+// Event is one structured log line of a worker, Seq orders the events of the
+// log store and Time is unix milliseconds
+type Event struct {
+	Seq       uint64            `json:"seq"`
+	Time      int64             `json:"time"`
+	Level     string            `json:"level"`
+	Pipeline  string            `json:"pipeline"`
+	Component string            `json:"component"`
+	Method    string            `json:"method"`
+	Uid       uint32            `json:"uid,omitempty"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+// EventPage is one page of the event query API, newest first, More is set
+// when older events match too
+type EventPage struct {
+	Events []Event `json:"events"`
+	More   bool    `json:"more"`
 }
 
 type Param struct {
@@ -36,16 +148,55 @@ type Param struct {
 }
 
 type HttpSender struct {
-	Params    []Param `json:"params"`
-	Timestamp int64   `json:"timestamp"`
-	NextRun   int64   `json:"next_run"`
+	Id        string      `json:"id"`
+	Params    []Param     `json:"params"`
+	Timestamp int64       `json:"timestamp"`
+	NextRun   int64       `json:"next_run"`
+	Attempts  int         `json:"attempts"`
+	LastError string      `json:"last_error"`
+	Source    *MessageRef `json:"source,omitempty"`
 }
 
 type HttpBody struct {
 	Params []Param `json:"params"`
 }
 
+type OAuthSettings struct {
+	ClientId     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	RefreshToken string `json:"refreshToken"`
+	TokenUrl     string `json:"tokenUrl"`
+	Scope        string `json:"scope"`
+}
+
 type EmailPwdBody struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string        `json:"email"`
+	Password string        `json:"password"`
+	AuthType string        `json:"authType"`
+	OAuth    OAuthSettings `json:"oauth"`
+}
+
+type PatternTestBody struct {
+	Format   string                  `json:"format"`
+	Raw      string                  `json:"raw"`
+	Patterns []ServiceContentPattern `json:"patterns"`
+}
+
+type PatternMatch struct {
+	Param   string  `json:"param"`
+	Target  string  `json:"target"`
+	Text    string  `json:"text"`
+	Matches int     `json:"matches"`
+	Params  []Param `json:"params"`
+	Require bool    `json:"require"`
+	Error   string  `json:"error"`
+}
+
+type PatternTestResponse struct {
+	Send          bool           `json:"send"`
+	CallbackBody  string         `json:"callbackBody"`
+	Patterns      []PatternMatch `json:"patterns"`
+	RequireFailed []string       `json:"requireFailed"`
+	Attachments   []string       `json:"attachments"`
+	Error         string         `json:"error"`
 }
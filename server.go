@@ -1,32 +1,52 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"flag"
 	v2 "github.com/VirgilZhao/mailtohttp/email/v2"
 	"github.com/VirgilZhao/mailtohttp/model"
-	"github.com/VirgilZhao/mailtohttp/utils"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 	"io/fs"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 //go:embed app
 var embedFiles embed.FS
-var status = "stopped"
-var msgChan = make(chan string, 100)
-var updateNotifyChan = make(chan string, 10)
-var idleApp *v2.IdleApp
-var receiveApp *v2.ReceiveApp
+var msgChan = make(chan string, 1000)
+var pipelines = make(map[string]*v2.Pipeline)
+var pipelinesLock sync.Mutex
+
+// shuttingDown is set by shutdown, no pipeline is started afterwards
+var shuttingDown bool
+var sessions *sessionStore
+var pipelineNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
 
 const (
 	configFileName = "config.mtt"
 	configEPName   = "ep.mtt"
+	configTLSName  = "tls.mtt"
+	dataDirName    = "data"
+	// desired state of every pipeline, running pipelines are started on boot
+	desiredStateFileName = dataDirName + "/state.json"
+	defaultName          = "default"
+	// largest mail accepted by the pattern test api
+	maxPatternTestSize = 10 << 20
 )
 
 func getFileSystem(useOs bool) http.FileSystem {
@@ -42,199 +62,569 @@ func getFileSystem(useOs bool) http.FileSystem {
 	return http.FS(fsys)
 }
 
-func loginHandler(c echo.Context) error {
-	passwordCheck := c.Param("passText")
-	login := "fail"
-	if *password == passwordCheck {
-		login = "ok"
-	}
-	config := loadConfig()
-	sendMessage("status", status)
-	return c.JSON(200, model.LoginResponse{
-		Login:  login,
-		Config: *config,
-	})
+func pipelineInfos() []model.PipelineInfo {
+	pipelinesLock.Lock()
+	defer pipelinesLock.Unlock()
+	infos := make([]model.PipelineInfo, 0)
+	desired := loadDesiredStates()
+	for _, config := range loadConfigs() {
+		status := v2.StatusStopped
+		workers := make([]model.WorkerStatus, 0)
+		if p, ok := pipelines[config.Name]; ok {
+			status = p.Status()
+			workers = p.Workers()
+		}
+		infos = append(infos, model.PipelineInfo{
+			Config:    config,
+			Status:    status,
+			Workers:   workers,
+			AutoStart: desired[config.Name] == v2.StatusRunning,
+		})
+	}
+	return infos
+}
+
+func listPipelinesHandler(c echo.Context) error {
+	return c.JSON(200, pipelineInfos())
 }
 
-func saveConfigFile(c echo.Context) error {
+func savePipelineHandler(c echo.Context) error {
 	config := model.ServiceConfig{
 		ContentPatterns: make([]model.ServiceContentPattern, 0),
 	}
 	if err := c.Bind(&config); err != nil {
 		return c.JSON(200, err.Error())
 	}
-	saveConfig(&config)
-	return c.JSON(200, "ok")
-}
-
-func saveConfigEPFile(c echo.Context) error {
-	config := model.EmailPwdBody{}
-	if err := c.Bind(&config); err != nil {
+	if err := validateConfig(&config); err != nil {
+		return c.JSON(200, err.Error())
+	}
+	pipelinesLock.Lock()
+	configs := loadConfigs()
+	found := false
+	for i := range configs {
+		if configs[i].Name == config.Name {
+			configs[i] = config
+			found = true
+		} else if err := checkRecipients(&configs[i], &config); err != nil {
+			pipelinesLock.Unlock()
+			return c.JSON(200, err.Error())
+		}
+	}
+	if !found {
+		configs = append(configs, config)
+	}
+	if err := saveConfigs(configs); err != nil {
+		pipelinesLock.Unlock()
 		return c.JSON(200, err.Error())
 	}
-	saveEmailPwd(&config)
+	pipelinesLock.Unlock()
+	reloadPipeline(config.Name)
 	return c.JSON(200, "ok")
 }
 
-func startServiceHandler(c echo.Context) error {
-	config := loadConfig()
-	epConfig := loadEPConfig()
-	config.EmailSettings.Email = epConfig.Email
-	config.EmailSettings.Password = epConfig.Password
-	// go startEmailLoop(config)
-	if idleApp == nil {
-		idleApp = v2.NewIdleApp(config, msgChan)
-	}
-	go idleApp.Start(updateNotifyChan)
-	if receiveApp == nil {
-		receiveApp = v2.NewReceiveApp(config, msgChan)
-	}
-	go receiveApp.Start(updateNotifyChan)
-	status = "running"
-	sendMessage("status", status)
-	return c.JSON(200, "ok")
+func validateConfig(config *model.ServiceConfig) error {
+	if !pipelineNameRegex.MatchString(config.Name) {
+		return errors.New("invalid pipeline name, use letters, numbers, '_' or '-'")
+	}
+	if !v2.ValidSecurity(config.EmailSettings.Security) {
+		return errors.New("invalid security mode " + config.EmailSettings.Security)
+	}
+	if !v2.ValidSourceType(config.EmailSettings.SourceType) {
+		return errors.New("invalid source type " + config.EmailSettings.SourceType)
+	}
+	if config.EmailSettings.PollInterval < 0 {
+		return errors.New("invalid poll interval")
+	}
+	if err := v2.ValidateFilter(config.EmailSettings.Filter); err != nil {
+		return err
+	}
+	if err := v2.ValidateAction(config.EmailSettings.OnSuccess); err != nil {
+		return err
+	}
+	if err := v2.ValidateAction(config.EmailSettings.OnFailure); err != nil {
+		return err
+	}
+	sourceType := config.EmailSettings.SourceType
+	if (sourceType == v2.SourceMaildir || sourceType == v2.SourceMbox) && config.EmailSettings.Path == "" {
+		return errors.New("a path is required for the " + sourceType + " source")
+	}
+	if sourceType == v2.SourceSMTP && len(config.EmailSettings.Recipients) == 0 {
+		return errors.New("at least one recipient is required for the smtp source")
+	}
+	for _, entry := range append(config.EmailSettings.Recipients, config.EmailSettings.AllowedSenders...) {
+		if !v2.ValidAddressEntry(entry) {
+			return errors.New("invalid address " + entry + ", use user@example.org or @example.org")
+		}
+	}
+	for _, pattern := range config.ContentPatterns {
+		if err := v2.ValidatePattern(pattern); err != nil {
+			return err
+		}
+	}
+	if config.CallbackUrl != "" {
+		u, err := url.Parse(config.CallbackUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("invalid callback url, use a http or https url")
+		}
+	}
+	return nil
 }
 
-func stopServiceHandler(c echo.Context) error {
-	// stopEmailLoop()
-	if idleApp != nil {
-		idleApp.Stop()
+// checkRecipients makes sure a pushed mail is routed to one pipeline only
+func checkRecipients(other, config *model.ServiceConfig) error {
+	if other.EmailSettings.SourceType != v2.SourceSMTP || config.EmailSettings.SourceType != v2.SourceSMTP {
+		return nil
 	}
-	if receiveApp != nil {
-		receiveApp.Stop()
+	for _, entry := range config.EmailSettings.Recipients {
+		for _, otherEntry := range other.EmailSettings.Recipients {
+			if strings.EqualFold(strings.TrimSpace(entry), strings.TrimSpace(otherEntry)) {
+				return errors.New("recipient " + entry + " is already used by pipeline " + other.Name)
+			}
+		}
 	}
-	status = "stopped"
-	sendMessage("status", status)
-	return c.JSON(200, "ok")
+	return nil
 }
 
-var logSocket = websocket.Upgrader{}
-var conn *websocket.Conn
+// reloadPipeline pushes the saved config into a running pipeline, it runs
+// without pipelinesLock because restarting workers can take a while
+func reloadPipeline(name string) {
+	pipelinesLock.Lock()
+	p, ok := pipelines[name]
+	config := runtimeConfig(name)
+	pipelinesLock.Unlock()
+	if !ok || config == nil {
+		return
+	}
+	p.Reload(config)
+}
 
-func webSocketHandler(c echo.Context) error {
-	var err error
-	if conn != nil {
-		conn.Close()
+// runtimeConfig returns the saved config of a pipeline with its email account,
+// must be called with pipelinesLock held
+func runtimeConfig(name string) *model.ServiceConfig {
+	config := findConfig(loadConfigs(), name)
+	if config == nil {
+		return nil
 	}
-	conn, err = logSocket.Upgrade(c.Response(), c.Request(), nil)
-	if err != nil {
-		panic(err)
+	ep := loadEPConfigs()[name]
+	config.EmailSettings.Email = ep.Email
+	config.EmailSettings.Password = ep.Password
+	config.EmailSettings.AuthType = ep.AuthType
+	if ep.AuthType == v2.AuthXOAuth2 || ep.AuthType == v2.AuthOAuthBearer {
+		oauth := ep.OAuth
+		config.EmailSettings.OAuth = &oauth
 	}
-	go messageLoop()
-	return nil
+	if tlsSettings, ok := loadTLSConfigs()[name]; ok {
+		config.EmailSettings.TLS = &tlsSettings
+	}
+	return config
 }
 
-func messageLoop() {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println(err)
-			return
+func deletePipelineHandler(c echo.Context) error {
+	name := c.Param("name")
+	pipelinesLock.Lock()
+	p, ok := pipelines[name]
+	err := deletePipelineConfig(name)
+	pipelinesLock.Unlock()
+	// the workers are waited for without pipelinesLock, the config is gone
+	// already so the pipeline can't be started again meanwhile. One whose
+	// workers are still busy stays, a new pipeline of that name must wait
+	if ok {
+		p.Stop()
+		pipelinesLock.Lock()
+		if pipelines[name] == p && p.Exited() {
+			delete(pipelines, name)
 		}
-	}()
-	for {
-		select {
-		case msg := <-msgChan:
-			err := conn.WriteMessage(websocket.TextMessage, []byte(msg))
-			if err != nil {
-				log.Println(err)
-				return
-			}
+		pipelinesLock.Unlock()
+	}
+	if err != nil {
+		return c.JSON(200, err.Error())
+	}
+	return c.JSON(200, "ok")
+}
+
+// deletePipelineConfig removes everything saved for a pipeline but its data
+// dir, must be called with pipelinesLock held
+func deletePipelineConfig(name string) error {
+	if err := saveDesiredState(name, ""); err != nil {
+		log.Println(err)
+	}
+	configs := loadConfigs()
+	for i := range configs {
+		if configs[i].Name == name {
+			configs = append(configs[:i], configs[i+1:]...)
 			break
 		}
 	}
+	if err := saveConfigs(configs); err != nil {
+		return err
+	}
+	epConfigs := loadEPConfigs()
+	delete(epConfigs, name)
+	if err := saveEPConfigs(epConfigs); err != nil {
+		return err
+	}
+	tlsConfigs := loadTLSConfigs()
+	if _, ok := tlsConfigs[name]; ok {
+		delete(tlsConfigs, name)
+		return saveTLSConfigs(tlsConfigs)
+	}
+	return nil
 }
 
-func sendMessage(ctype, data string) {
-	msg := model.SocketMessage{
-		MsgType: ctype,
-		Data:    data,
+func savePipelineEPHandler(c echo.Context) error {
+	name := c.Param("name")
+	config := model.EmailPwdBody{}
+	if err := c.Bind(&config); err != nil {
+		return c.JSON(200, err.Error())
 	}
-	bytes, err := json.Marshal(&msg)
-	if err != nil {
+	if !v2.ValidAuthType(config.AuthType) {
+		return c.JSON(200, "invalid auth type "+config.AuthType)
+	}
+	if config.AuthType == v2.AuthXOAuth2 || config.AuthType == v2.AuthOAuthBearer {
+		if err := v2.ValidateOAuth(config.OAuth); err != nil {
+			return c.JSON(200, err.Error())
+		}
+	}
+	pipelinesLock.Lock()
+	epConfigs := loadEPConfigs()
+	epConfigs[name] = config
+	if err := saveEPConfigs(epConfigs); err != nil {
+		pipelinesLock.Unlock()
+		return c.JSON(200, err.Error())
+	}
+	pipelinesLock.Unlock()
+	reloadPipeline(name)
+	return c.JSON(200, "ok")
+}
+
+// saveRefreshToken stores a rotated OAuth2 refresh token, the running pipeline
+// keeps using its token source so it is not reloaded
+func saveRefreshToken(name, refreshToken string) {
+	pipelinesLock.Lock()
+	defer pipelinesLock.Unlock()
+	epConfigs := loadEPConfigs()
+	ep, ok := epConfigs[name]
+	if !ok {
+		return
+	}
+	ep.OAuth.RefreshToken = refreshToken
+	epConfigs[name] = ep
+	if err := saveEPConfigs(epConfigs); err != nil {
 		log.Println(err)
 		return
 	}
-	msgChan <- string(bytes)
+	log.Println("[" + name + "] OAuth2 refresh token rotated and saved")
 }
 
-func loadConfig() *model.ServiceConfig {
-	config := model.ServiceConfig{
-		ContentPatterns: make([]model.ServiceContentPattern, 0),
+// getPipelineTLSHandler returns the TLS settings without the client key
+func getPipelineTLSHandler(c echo.Context) error {
+	name := c.Param("name")
+	pipelinesLock.Lock()
+	settings := loadTLSConfigs()[name]
+	pipelinesLock.Unlock()
+	settings.HasClientKey = settings.ClientKey != ""
+	settings.ClientKey = ""
+	return c.JSON(200, settings)
+}
+
+// savePipelineTLSHandler keeps the stored client key when the request has a
+// client certificate but no key, so the key doesn't have to be sent again
+func savePipelineTLSHandler(c echo.Context) error {
+	name := c.Param("name")
+	settings := model.TLSSettings{}
+	if err := c.Bind(&settings); err != nil {
+		return c.JSON(200, err.Error())
 	}
-	if !checkConfigExist(configFileName) {
-		return &config
+	pipelinesLock.Lock()
+	tlsConfigs := loadTLSConfigs()
+	if settings.ClientKey == "" && settings.ClientCert != "" {
+		settings.ClientKey = tlsConfigs[name].ClientKey
 	}
-	bytes, err := ioutil.ReadFile(configFileName)
-	if err != nil {
-		log.Println(err)
-		return &config
+	settings.HasClientKey = false
+	if _, err := v2.BuildTLSConfig("", &settings); err != nil {
+		pipelinesLock.Unlock()
+		return c.JSON(200, err.Error())
 	}
-	jsonStr := utils.AesDecryptCBC(bytes, []byte(*encryptKey))
-	log.Println(string(jsonStr))
-	err = json.Unmarshal(jsonStr, &config)
-	if err != nil {
-		log.Println(err)
-		return &config
+	tlsConfigs[name] = settings
+	if err := saveTLSConfigs(tlsConfigs); err != nil {
+		pipelinesLock.Unlock()
+		return c.JSON(200, err.Error())
 	}
-	return &config
+	pipelinesLock.Unlock()
+	reloadPipeline(name)
+	return c.JSON(200, "ok")
 }
 
-func saveConfig(config *model.ServiceConfig) error {
-	if checkConfigExist(configFileName) {
-		os.Remove(configFileName)
+func startPipelineHandler(c echo.Context) error {
+	name := c.Param("name")
+	pipelinesLock.Lock()
+	defer pipelinesLock.Unlock()
+	if err := startPipeline(name); err != nil {
+		return c.JSON(200, err.Error())
 	}
-	bytes, err := json.Marshal(config)
-	if err != nil {
+	if err := saveDesiredState(name, v2.StatusRunning); err != nil {
 		log.Println(err)
-		return err
 	}
-	encryptBytes := utils.AesEncryptCBC(bytes, []byte(*encryptKey))
-	err = ioutil.WriteFile(configFileName, encryptBytes, 0666)
-	if err != nil {
+	return c.JSON(200, "ok")
+}
+
+// startPipeline must be called with pipelinesLock held
+func startPipeline(name string) error {
+	if shuttingDown {
+		return errors.New("the service is shutting down")
+	}
+	config := runtimeConfig(name)
+	if config == nil {
+		return errors.New("pipeline not found")
+	}
+	p, ok := pipelines[name]
+	if !ok || (p.Status() == v2.StatusStopped && p.Exited()) {
+		// a stopped pipeline is rebuilt so the latest saved config is used,
+		// one whose workers are still busy is kept so Start refuses
+		p = v2.NewPipeline(config, msgChan, filepath.Join(dataDirName, name))
+		p.OnRefreshToken = saveRefreshToken
+		pipelines[name] = p
+	}
+	return p.Start()
+}
+
+// stopPipelineHandler waits for the workers without pipelinesLock, so the
+// pipeline list and the other pipelines aren't held up meanwhile
+func stopPipelineHandler(c echo.Context) error {
+	name := c.Param("name")
+	pipelinesLock.Lock()
+	p, ok := pipelines[name]
+	if err := saveDesiredState(name, v2.StatusStopped); err != nil {
 		log.Println(err)
-		return err
+	}
+	pipelinesLock.Unlock()
+	if ok {
+		p.Stop()
+	}
+	return c.JSON(200, "ok")
+}
+
+// autoStartPipelines starts the pipelines that were running when the service
+// went down
+func autoStartPipelines() {
+	pipelinesLock.Lock()
+	defer pipelinesLock.Unlock()
+	desired := loadDesiredStates()
+	for _, config := range loadConfigs() {
+		if desired[config.Name] != v2.StatusRunning {
+			continue
+		}
+		if err := startPipeline(config.Name); err != nil {
+			log.Println("[" + config.Name + "] auto start error:" + err.Error())
+			continue
+		}
+		log.Println("[" + config.Name + "] auto started")
+	}
+}
+
+// shutdown stops every pipeline at the same time without changing the desired
+// states, so they are started again on the next boot. The web server keeps
+// serving meanwhile, start requests are refused from here on
+func shutdown(timeout time.Duration) {
+	pipelinesLock.Lock()
+	shuttingDown = true
+	running := make([]*v2.Pipeline, 0, len(pipelines))
+	for _, p := range pipelines {
+		running = append(running, p)
+	}
+	pipelinesLock.Unlock()
+	var wg sync.WaitGroup
+	for _, p := range running {
+		wg.Add(1)
+		go func(p *v2.Pipeline) {
+			defer wg.Done()
+			p.Shutdown(timeout)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// routeRecipient picks the saved pipeline whose recipients match rcpt, a full
+// address wins over a domain entry. A pipeline that isn't running is still
+// returned so the MTA gets a temporary failure instead of a bounce
+func routeRecipient(rcpt string) v2.MailTarget {
+	pipelinesLock.Lock()
+	defer pipelinesLock.Unlock()
+	configs := loadConfigs()
+	for _, exact := range []bool{true, false} {
+		for i := range configs {
+			if !v2.AcceptsRecipient(&configs[i], rcpt, exact) {
+				continue
+			}
+			if p, ok := pipelines[configs[i].Name]; ok {
+				return p
+			}
+			return v2.StoppedTarget{}
+		}
 	}
 	return nil
 }
 
-func loadEPConfig() *model.EmailPwdBody {
-	config := model.EmailPwdBody{}
-	if !checkConfigExist(configEPName) {
-		return &config
+func findConfig(configs []model.ServiceConfig, name string) *model.ServiceConfig {
+	for i := range configs {
+		if configs[i].Name == name {
+			return &configs[i]
+		}
 	}
-	bytes, err := ioutil.ReadFile(configEPName)
-	if err != nil {
-		log.Println(err)
-		return &config
+	return nil
+}
+
+// patternTestHandler runs the extractor of ReceiveApp on a pasted or uploaded
+// mail, the body is json PatternTestBody or a multipart form with the fields
+// file, format and patterns (json array)
+func patternTestHandler(c echo.Context) error {
+	body := model.PatternTestBody{}
+	if file, err := c.FormFile("file"); err == nil {
+		if file.Size > maxPatternTestSize {
+			return c.JSON(200, model.PatternTestResponse{Error: "mail is too large"})
+		}
+		f, err := file.Open()
+		if err != nil {
+			return c.JSON(200, model.PatternTestResponse{Error: err.Error()})
+		}
+		raw, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return c.JSON(200, model.PatternTestResponse{Error: err.Error()})
+		}
+		body.Raw = string(raw)
+		body.Format = c.FormValue("format")
+		if err := json.Unmarshal([]byte(c.FormValue("patterns")), &body.Patterns); err != nil {
+			return c.JSON(200, model.PatternTestResponse{Error: "invalid patterns: " + err.Error()})
+		}
+	} else if err := c.Bind(&body); err != nil {
+		return c.JSON(200, model.PatternTestResponse{Error: err.Error()})
 	}
-	jsonStr := utils.AesDecryptCBC(bytes, []byte(*encryptKey))
-	log.Println("load EP config success!")
-	err = json.Unmarshal(jsonStr, &config)
-	if err != nil {
-		log.Println(err)
-		return &config
+	if len(body.Raw) > maxPatternTestSize {
+		return c.JSON(200, model.PatternTestResponse{Error: "mail is too large"})
+	}
+	for _, pattern := range body.Patterns {
+		if err := v2.ValidatePattern(pattern); err != nil {
+			return c.JSON(200, model.PatternTestResponse{Error: err.Error()})
+		}
+	}
+	mc := &v2.MailContent{Body: body.Raw}
+	resp := model.PatternTestResponse{}
+	if body.Format != "text" {
+		parsed, err := v2.ParseMail(strings.NewReader(body.Raw))
+		if err != nil {
+			resp.Error = "parse mail error: " + err.Error()
+			if parsed == nil {
+				return c.JSON(200, resp)
+			}
+		}
+		mc = parsed
+	}
+	result := v2.Extract(mc, body.Patterns)
+	resp.Send = result.Send
+	resp.Patterns = result.Patterns
+	resp.RequireFailed = result.RequireFailed
+	resp.Attachments = mc.Attachments
+	if result.Send {
+		callbackBody, err := v2.CallbackBody(result.Params)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		resp.CallbackBody = string(callbackBody)
+	}
+	return c.JSON(200, resp)
+}
+
+var logSocket = websocket.Upgrader{}
+var hub *logHub
+var events *eventStore
+
+// pumpMessages hands every message from msgChan to the hub, the events in
+// them were stored by v2.EventSink already. It runs until msgChan is closed
+func pumpMessages() {
+	for msg := range msgChan {
+		data := model.SocketMessage{}
+		if err := json.Unmarshal([]byte(msg), &data); err != nil {
+			log.Println(err)
+			continue
+		}
+		hub.publish(data.MsgType, msg)
 	}
-	return &config
 }
 
-func saveEmailPwd(body *model.EmailPwdBody) error {
-	if checkConfigExist(configEPName) {
-		os.Remove(configEPName)
+// eventsHandler queries the event log, from and to are RFC 3339 times,
+// before is the seq of the oldest event already shown
+func eventsHandler(c echo.Context) error {
+	q := eventQuery{
+		Level:    c.QueryParam("level"),
+		Pipeline: c.QueryParam("pipeline"),
+		Text:     c.QueryParam("q"),
+	}
+	if q.Level != "" && v2.LevelRank(q.Level) < 0 {
+		return c.JSON(400, "invalid level "+q.Level)
+	}
+	for _, param := range []struct {
+		name   string
+		target *int64
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if value := c.QueryParam(param.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return c.JSON(400, "invalid "+param.name+" "+value)
+			}
+			*param.target = t.UnixNano() / int64(time.Millisecond)
+		}
+	}
+	if value := c.QueryParam("before"); value != "" {
+		before, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return c.JSON(400, "invalid before "+value)
+		}
+		q.Before = before
+	}
+	q.Limit = 100
+	if value := c.QueryParam("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return c.JSON(400, "invalid limit "+value)
+		}
+		q.Limit = limit
 	}
-	bytes, err := json.Marshal(body)
+	if events == nil {
+		return c.JSON(200, model.EventPage{Events: make([]model.Event, 0)})
+	}
+	list, more, err := events.Query(q)
 	if err != nil {
-		log.Println(err)
-		return err
+		return c.JSON(500, err.Error())
 	}
-	encryptBytes := utils.AesEncryptCBC(bytes, []byte(*encryptKey))
-	err = ioutil.WriteFile(configEPName, encryptBytes, 0666)
+	return c.JSON(200, model.EventPage{Events: list, More: more})
+}
+
+func webSocketHandler(c echo.Context) error {
+	conn, err := logSocket.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		log.Println(err)
-		return err
+		return nil
 	}
+	hub.add(conn)
+	log.Printf("websocket client %s connected, %d clients\n", conn.RemoteAddr(), hub.count())
 	return nil
 }
 
+func sendMessage(ctype, pipeline, data string) {
+	msg := model.SocketMessage{
+		MsgType:  ctype,
+		Pipeline: pipeline,
+		Data:     data,
+	}
+	bytes, err := json.Marshal(&msg)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	msgChan <- string(bytes)
+}
+
 func checkConfigExist(fileName string) bool {
 	_, err := os.Stat(fileName)
 	if os.IsNotExist(err) {
@@ -246,23 +636,93 @@ func checkConfigExist(fileName string) bool {
 var live = flag.Bool("live", false, "use live mode")
 var port = flag.String("port", "1323", "http port")
 var password = flag.String("password", "ucommune", "password")
-var encryptKey = flag.String("encryptKey", "TISISVIRGLCRATDP", "encrypt key length must be 16 strings")
+var sessionTTL = flag.Duration("sessionTTL", 12*time.Hour, "login session expiry")
+var encryptKey = flag.String("encryptKey", "TISISVIRGLCRATDP", "passphrase used to encrypt config files")
+var smtpAddr = flag.String("smtpAddr", "", "listen address of the SMTP/LMTP receiver, like 127.0.0.1:2525, empty disables it")
+var lmtp = flag.Bool("lmtp", false, "speak LMTP instead of SMTP on smtpAddr")
+var smtpMaxSize = flag.Int64("smtpMaxSize", 25<<20, "largest mail accepted by the SMTP/LMTP receiver in bytes")
+var autoStart = flag.Bool("autoStart", true, "start the pipelines that were running when the service stopped")
+var logReplay = flag.Int("logReplay", 100, "log lines replayed to a web page when it connects")
+var eventLogSize = flag.Int64("eventLogSize", 10<<20, "size in bytes at which data/events/events.log is rotated")
+var eventLogFiles = flag.Int("eventLogFiles", 5, "rotated event log files kept")
+var shutdownTimeout = flag.Duration("shutdownTimeout", 20*time.Second, "time given to pending callbacks on SIGINT or SIGTERM")
 
 func main() {
 	flag.Parse()
-	if len(*encryptKey) != 16 {
-		panic("encrpytKey must be 16 characters")
+	if *encryptKey == "" {
+		panic("encryptKey must not be empty")
+	}
+	if err := checkEncryptFiles(); err != nil {
+		log.Fatalln("can not read config files, check encryptKey:", err)
+	}
+	sessions = newSessionStore(*sessionTTL)
+	hub = newLogHub(*logReplay)
+	if *eventLogSize <= 0 || *eventLogFiles < 0 {
+		log.Fatalln("eventLogSize must be positive and eventLogFiles must not be negative")
+	}
+	if store, err := newEventStore(filepath.Join(dataDirName, "events"), *eventLogSize, *eventLogFiles); err != nil {
+		log.Println("event log disabled:", err)
+	} else {
+		events = store
+		v2.EventSink = store.Append
+	}
+	go pumpMessages()
+	var smtpServer *v2.SmtpServer
+	if *smtpAddr != "" {
+		smtpServer = &v2.SmtpServer{
+			Addr:    *smtpAddr,
+			LMTP:    *lmtp,
+			MaxSize: *smtpMaxSize,
+			Route:   routeRecipient,
+		}
+		go func() {
+			if err := smtpServer.ListenAndServe(); err != v2.ErrServerClosed {
+				log.Fatalln(err)
+			}
+		}()
 	}
 	e := echo.New()
-	log.Printf("flag set %v %v %v\n", *live, *port, *password)
+	log.Printf("flag set %v %v\n", *live, *port)
 	assetHandler := http.FileServer(getFileSystem(*live))
 	e.GET("/", echo.WrapHandler(assetHandler))
-	e.GET("/api/password/:passText", loginHandler)
-	e.POST("/api/config", saveConfigFile)
-	e.POST("/api/ep_config", saveConfigEPFile)
-	e.GET("/api/service/start", startServiceHandler)
-	e.GET("/api/service/stop", stopServiceHandler)
-	e.GET("/ws", webSocketHandler)
+	e.POST("/api/login", loginHandler)
+	api := e.Group("/api", authMiddleware)
+	api.POST("/logout", logoutHandler)
+	api.GET("/pipelines", listPipelinesHandler)
+	api.POST("/pipelines", savePipelineHandler)
+	api.DELETE("/pipelines/:name", deletePipelineHandler)
+	api.POST("/pipelines/:name/ep_config", savePipelineEPHandler)
+	api.GET("/pipelines/:name/tls", getPipelineTLSHandler)
+	api.POST("/pipelines/:name/tls", savePipelineTLSHandler)
+	api.GET("/pipelines/:name/start", startPipelineHandler)
+	api.GET("/pipelines/:name/stop", stopPipelineHandler)
+	api.POST("/pattern/test", patternTestHandler)
+	api.GET("/events", eventsHandler)
+	e.GET("/ws", webSocketHandler, authMiddleware)
 	e.GET("/static/*", echo.WrapHandler(http.StripPrefix("/static/", assetHandler)))
-	e.Logger.Fatal(e.Start(":" + *port))
+	if *autoStart {
+		autoStartPipelines()
+	}
+	go func() {
+		if err := e.Start(":" + *port); err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("%v received, shutting down\n", sig)
+	// no new mails while the pipelines drain, a second signal exits at once
+	signal.Stop(signals)
+	if smtpServer != nil {
+		smtpServer.Close()
+	}
+	shutdown(*shutdownTimeout)
+	hub.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+	log.Println("shutdown complete")
 }
@@ -0,0 +1,135 @@
+// Package signature signs mailtohttp callback requests and lets the receiving
+// service verify them.
+//
+// Every callback carries the unix timestamp in TimestampHeader, the delivery id
+// in DeliveryHeader and
+// "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + delivery + "." + body))
+// in SignatureHeader. A retried delivery keeps its id, so a receiver that gets
+// ErrReplayed already has the callback. A receiver verifies a request like this:
+//
+//	verifier := signature.NewVerifier([]byte("callback secret"), 5*time.Minute)
+//	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+//		body, err := verifier.VerifyRequest(r)
+//		if err == signature.ErrReplayed {
+//			return
+//		}
+//		if err != nil {
+//			http.Error(w, err.Error(), http.StatusUnauthorized)
+//			return
+//		}
+//		// body is the callback json
+//	})
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TimestampHeader = "X-Mailtohttp-Timestamp"
+	DeliveryHeader  = "X-Mailtohttp-Delivery"
+	SignatureHeader = "X-Mailtohttp-Signature"
+	signaturePrefix = "sha256="
+)
+
+var (
+	ErrMissingHeader    = errors.New("signature: missing timestamp, delivery or signature header")
+	ErrInvalidTimestamp = errors.New("signature: invalid timestamp")
+	ErrExpired          = errors.New("signature: timestamp outside tolerance")
+	ErrMismatch         = errors.New("signature: signature mismatch")
+	ErrReplayed         = errors.New("signature: delivery already received")
+)
+
+// Sign returns the signature header value of body sent at timestamp as delivery
+func Sign(secret []byte, timestamp int64, delivery string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write([]byte(delivery))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the timestamp, delivery and signature headers of req, body
+// must be the exact bytes sent as request body
+func SignRequest(req *http.Request, secret []byte, delivery string, body []byte) {
+	timestamp := time.Now().Unix()
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(DeliveryHeader, delivery)
+	req.Header.Set(SignatureHeader, Sign(secret, timestamp, delivery, body))
+}
+
+// Verifier checks signatures and rejects requests whose timestamp is older
+// than Tolerance or whose delivery id was already seen within Tolerance
+type Verifier struct {
+	Secret    []byte
+	Tolerance time.Duration
+	seen      map[string]time.Time
+	lock      sync.Mutex
+}
+
+func NewVerifier(secret []byte, tolerance time.Duration) *Verifier {
+	return &Verifier{
+		Secret:    secret,
+		Tolerance: tolerance,
+		seen:      make(map[string]time.Time),
+	}
+}
+
+// Verify checks the header values of one request against body
+func (v *Verifier) Verify(timestamp, delivery, sig string, body []byte) error {
+	if timestamp == "" || delivery == "" || sig == "" {
+		return ErrMissingHeader
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	now := time.Now()
+	sent := time.Unix(ts, 0)
+	if sent.Before(now.Add(-v.Tolerance)) || sent.After(now.Add(v.Tolerance)) {
+		return ErrExpired
+	}
+	expected := Sign(v.Secret, ts, delivery, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(sig))) {
+		return ErrMismatch
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for key, seenAt := range v.seen {
+		if seenAt.Before(now.Add(-2 * v.Tolerance)) {
+			delete(v.seen, key)
+		}
+	}
+	if _, ok := v.seen[delivery]; ok {
+		return ErrReplayed
+	}
+	v.seen[delivery] = now
+	return nil
+}
+
+// VerifyRequest reads and verifies the body of r, the body is returned and
+// also put back on r so later handlers can read it again
+func (v *Verifier) VerifyRequest(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err := v.Verify(r.Header.Get(TimestampHeader), r.Header.Get(DeliveryHeader), r.Header.Get(SignatureHeader), body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
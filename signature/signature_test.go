@@ -0,0 +1,91 @@
+package signature
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("callback secret")
+
+func signedRequest(t *testing.T, delivery string, body []byte) *http.Request {
+	req, err := http.NewRequest("POST", "http://127.0.0.1/callback", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SignRequest(req, testSecret, delivery, body)
+	return req
+}
+
+func TestVerifyRequest(t *testing.T) {
+	v := NewVerifier(testSecret, time.Minute)
+	body := []byte(`{"code":"123456"}`)
+	got, err := v.VerifyRequest(signedRequest(t, "d1", body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("body %q", got)
+	}
+	if _, err := v.VerifyRequest(signedRequest(t, "d2", body)); err != nil {
+		t.Fatal("same body as another delivery:", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"code":"123456"}`)
+	now := time.Now().Unix()
+	ts := strconv.FormatInt(now, 10)
+	sig := Sign(testSecret, now, "d1", body)
+	tests := []struct {
+		name      string
+		timestamp string
+		delivery  string
+		sig       string
+		body      []byte
+		err       error
+	}{
+		{"missing timestamp", "", "d1", sig, body, ErrMissingHeader},
+		{"missing delivery", ts, "", sig, body, ErrMissingHeader},
+		{"missing signature", ts, "d1", "", body, ErrMissingHeader},
+		{"invalid timestamp", "now", "d1", sig, body, ErrInvalidTimestamp},
+		{"changed body", ts, "d1", sig, []byte(`{"code":"654321"}`), ErrMismatch},
+		{"changed delivery", ts, "d2", sig, body, ErrMismatch},
+		{"changed timestamp", strconv.FormatInt(now-1, 10), "d1", sig, body, ErrMismatch},
+		{"wrong secret", ts, "d1", Sign([]byte("other"), now, "d1", body), body, ErrMismatch},
+		{"expired", strconv.FormatInt(now-120, 10), "d1", Sign(testSecret, now-120, "d1", body), body, ErrExpired},
+		{"future", strconv.FormatInt(now+120, 10), "d1", Sign(testSecret, now+120, "d1", body), body, ErrExpired},
+	}
+	for _, test := range tests {
+		v := NewVerifier(testSecret, time.Minute)
+		if err := v.Verify(test.timestamp, test.delivery, test.sig, test.body); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	v := NewVerifier(testSecret, time.Minute)
+	body := []byte(`{"code":"123456"}`)
+	now := time.Now().Unix()
+	if err := v.Verify(strconv.FormatInt(now, 10), "d1", Sign(testSecret, now, "d1", body), body); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(strconv.FormatInt(now, 10), "d1", Sign(testSecret, now, "d1", body), body); err != ErrReplayed {
+		t.Fatalf("same request: got %v", err)
+	}
+	// a retry is signed again with a new timestamp but keeps the delivery id
+	retry := now + 5
+	if err := v.Verify(strconv.FormatInt(retry, 10), "d1", Sign(testSecret, retry, "d1", body), body); err != ErrReplayed {
+		t.Fatalf("retried delivery: got %v", err)
+	}
+	// a request that fails verification doesn't mark the delivery as seen
+	if err := v.Verify(strconv.FormatInt(now, 10), "d2", Sign(testSecret, now, "d1", body), body); err != ErrMismatch {
+		t.Fatalf("forged delivery: got %v", err)
+	}
+	if err := v.Verify(strconv.FormatInt(now, 10), "d2", Sign(testSecret, now, "d2", body), body); err != nil {
+		t.Fatal("delivery after a forged one:", err)
+	}
+}
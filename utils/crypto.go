@@ -4,36 +4,177 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/argon2"
+	"sync"
 )
 
+// =================== GCM ======================
+// file layout: magic(3) version(1) argon2 time(4) memory KiB(4) threads(1)
+// salt(16) nonce(12) ciphertext+tag, the whole header is authenticated as
+// additional data so it can't be changed without failing decryption
+
+const (
+	fileMagic      = "MTT"
+	fileVersion    = byte(2)
+	saltSize       = 16
+	nonceSize      = 12
+	headerSize     = len(fileMagic) + 1 + 4 + 4 + 1 + saltSize + nonceSize
+	argonTime      = uint32(3)
+	argonMemoryKiB = uint32(64 * 1024)
+	argonThreads   = uint8(4)
+	keySize        = 32
+)
+
+var (
+	ErrNotEncrypted = errors.New("data is not in encrypted file format")
+	ErrDecrypt      = errors.New("decrypt failed, wrong key or corrupted file")
+)
+
+// derived keys are cached, argon2 is slow on purpose and config files are
+// read on every api call. EncryptFile uses one salt per process, so the cache
+// holds that key and the keys of files written before the start, instead of a
+// new key for every save
+var keyCache = make(map[[sha256.Size]byte][]byte)
+var encryptSalt []byte
+var keyCacheLock sync.Mutex
+
+// fileSalt returns the salt of the files written by this process, nonces are
+// still random for every file
+func fileSalt() ([]byte, error) {
+	keyCacheLock.Lock()
+	defer keyCacheLock.Unlock()
+	if encryptSalt == nil {
+		salt := make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		encryptSalt = salt
+	}
+	return encryptSalt, nil
+}
+
+func deriveKey(passphrase string, salt []byte, iterations, memory uint32, threads uint8) []byte {
+	h := sha256.New()
+	h.Write([]byte(passphrase))
+	h.Write(salt)
+	binary.Write(h, binary.BigEndian, iterations)
+	binary.Write(h, binary.BigEndian, memory)
+	h.Write([]byte{threads})
+	var cacheKey [sha256.Size]byte
+	copy(cacheKey[:], h.Sum(nil))
+	keyCacheLock.Lock()
+	defer keyCacheLock.Unlock()
+	if key, ok := keyCache[cacheKey]; ok {
+		return key
+	}
+	key := argon2.IDKey([]byte(passphrase), salt, iterations, memory, threads, keySize)
+	keyCache[cacheKey] = key
+	return key
+}
+
+// IsEncryptedFile reports whether data starts with the versioned file header
+func IsEncryptedFile(data []byte) bool {
+	return len(data) >= headerSize && string(data[:len(fileMagic)]) == fileMagic && data[len(fileMagic)] == fileVersion
+}
+
+// EncryptFile encrypts data with AES-256-GCM using a key derived from
+// passphrase by argon2id with the random salt of the process, a random nonce
+// is used every time
+func EncryptFile(data []byte, passphrase string) ([]byte, error) {
+	header := make([]byte, 0, headerSize)
+	header = append(header, fileMagic...)
+	header = append(header, fileVersion)
+	header = appendUint32(header, argonTime)
+	header = appendUint32(header, argonMemoryKiB)
+	header = append(header, argonThreads)
+	salt, err := fileSalt()
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	aead, err := newGCM(deriveKey(passphrase, salt, argonTime, argonMemoryKiB, argonThreads))
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, nonce, data, header), nil
+}
+
+// DecryptFile reverses EncryptFile, ErrDecrypt is returned for a wrong
+// passphrase or any modified byte
+func DecryptFile(encrypted []byte, passphrase string) ([]byte, error) {
+	if !IsEncryptedFile(encrypted) {
+		return nil, ErrNotEncrypted
+	}
+	pos := len(fileMagic) + 1
+	iterations := binary.BigEndian.Uint32(encrypted[pos:])
+	memory := binary.BigEndian.Uint32(encrypted[pos+4:])
+	threads := encrypted[pos+8]
+	pos += 9
+	salt := encrypted[pos : pos+saltSize]
+	nonce := encrypted[pos+saltSize : headerSize]
+	// a corrupted header must not make argon2 allocate gigabytes
+	if iterations == 0 || iterations > 100 || threads == 0 || memory > 1024*1024 {
+		return nil, ErrDecrypt
+	}
+	aead, err := newGCM(deriveKey(passphrase, salt, iterations, memory, threads))
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := aead.Open(nil, nonce, encrypted[headerSize:], encrypted[:headerSize])
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return decrypted, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
 // =================== CBC ======================
-func AesEncryptCBC(origData []byte, key []byte) (encrypted []byte) {
-	// 分组秘钥
-	// NewCipher该函数限制了输入k的长度必须为16, 24或者32
-	block, _ := aes.NewCipher(key)
-	blockSize := block.BlockSize()                              // 获取秘钥块的长度
-	origData = pkcs5Padding(origData, blockSize)                // 补全码
-	blockMode := cipher.NewCBCEncrypter(block, key[:blockSize]) // 加密模式
-	encrypted = make([]byte, len(origData))                     // 创建数组
-	blockMode.CryptBlocks(encrypted, origData)                  // 加密
-	return encrypted
-}
-func AesDecryptCBC(encrypted []byte, key []byte) (decrypted []byte) {
-	block, _ := aes.NewCipher(key)                              // 分组秘钥
-	blockSize := block.BlockSize()                              // 获取秘钥块的长度
+// only kept to read files written by older versions, the key is used as IV
+// and there is no integrity check, so new files always use EncryptFile
+func AesDecryptCBC(encrypted []byte, key []byte) (decrypted []byte, err error) {
+	block, err := aes.NewCipher(key) // 分组秘钥
+	if err != nil {
+		return nil, err
+	}
+	blockSize := block.BlockSize() // 获取秘钥块的长度
+	if len(encrypted) == 0 || len(encrypted)%blockSize != 0 {
+		return nil, ErrDecrypt
+	}
 	blockMode := cipher.NewCBCDecrypter(block, key[:blockSize]) // 加密模式
 	decrypted = make([]byte, len(encrypted))                    // 创建数组
 	blockMode.CryptBlocks(decrypted, encrypted)                 // 解密
-	decrypted = pkcs5UnPadding(decrypted)                       // 去除补全码
-	return decrypted
-}
-func pkcs5Padding(ciphertext []byte, blockSize int) []byte {
-	padding := blockSize - len(ciphertext)%blockSize
-	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
-	return append(ciphertext, padtext...)
+	return pkcs5UnPadding(decrypted, blockSize)                 // 去除补全码
 }
-func pkcs5UnPadding(origData []byte) []byte {
+func pkcs5UnPadding(origData []byte, blockSize int) ([]byte, error) {
 	length := len(origData)
 	unpadding := int(origData[length-1])
-	return origData[:(length - unpadding)]
+	if unpadding == 0 || unpadding > blockSize || unpadding > length {
+		return nil, ErrDecrypt
+	}
+	if !bytes.Equal(origData[length-unpadding:], bytes.Repeat([]byte{byte(unpadding)}, unpadding)) {
+		return nil, ErrDecrypt
+	}
+	return origData[:(length - unpadding)], nil
 }